@@ -0,0 +1,216 @@
+package socksmitm
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/xerrors"
+)
+
+// Authenticator 校验 SOCKS5 用户名/密码 (RFC 1929)
+type Authenticator interface {
+	Authenticate(username, password string) bool
+}
+
+// AuthenticatorFunc 使用回调函数校验用户名/密码
+type AuthenticatorFunc func(username, password string) bool
+
+func (f AuthenticatorFunc) Authenticate(username, password string) bool {
+	return f(username, password)
+}
+
+// StaticAuthenticator 用户名 -> 明文密码
+type StaticAuthenticator map[string]string
+
+func (a StaticAuthenticator) Authenticate(username, password string) bool {
+	expected, ok := a[username]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// HtpasswdAuthenticator 从 htpasswd 格式文件读取用户, 支持 bcrypt, $apr1$ (htpasswd 默认的 MD5), {SHA} 和明文密码
+type HtpasswdAuthenticator struct {
+	path  string
+	mutex sync.RWMutex
+	users map[string]string
+}
+
+func NewHtpasswdAuthenticator(path string) (*HtpasswdAuthenticator, error) {
+	a := &HtpasswdAuthenticator{path: path}
+	err := a.Reload()
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	return a, nil
+}
+
+// Reload 重新读取 htpasswd 文件
+func (a *HtpasswdAuthenticator) Reload() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	defer f.Close()
+	users, err := parseHtpasswd(f)
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	a.mutex.Lock()
+	a.users = users
+	a.mutex.Unlock()
+	return nil
+}
+
+func (a *HtpasswdAuthenticator) Authenticate(username, password string) bool {
+	a.mutex.RLock()
+	hash, ok := a.users[username]
+	a.mutex.RUnlock()
+	if !ok {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, apr1Magic):
+		salt, _, _ := strings.Cut(hash[len(apr1Magic):], "$")
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(apr1Crypt(password, salt))) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	case strings.HasPrefix(hash, "$"):
+		return false // parseHtpasswd 已经拒绝了不支持的格式
+	default:
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1
+	}
+}
+
+func parseHtpasswd(r io.Reader) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, xerrors.Errorf("htpasswd line: %q", line)
+		}
+		if !htpasswdHashSupported(hash) {
+			// 否则该用户每次登录都会失败, 却没有任何提示
+			return nil, xerrors.Errorf("htpasswd user %q: unsupported hash format", username)
+		}
+		users[username] = hash
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	return users, nil
+}
+
+// htpasswdHashSupported 以 $ 开头的只支持 bcrypt 和 $apr1$, 其余 ($1$, $5$, $6$ 等 crypt 格式) 无法校验
+func htpasswdHashSupported(hash string) bool {
+	if !strings.HasPrefix(hash, "$") {
+		return true
+	}
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", apr1Magic} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+const apr1Magic = "$apr1$"
+
+// apr1Crypt Apache 的 MD5 crypt 变体, 与 htpasswd -m 和 openssl passwd -apr1 的结果相同
+func apr1Crypt(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(apr1Magic + salt))
+	alt := md5.Sum([]byte(password + salt + password))
+	for i := len(pw); i > 0; i -= 16 {
+		ctx.Write(alt[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out []byte
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[group[0]])<<16|uint32(final[group[1]])<<8|uint32(final[group[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+	return apr1Magic + salt + "$" + string(out)
+}
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	upstreamContextKey
+	socks4UserIDContextKey
+)
+
+// UserFromContext 返回认证通过的用户名, 可在 Mux 处理器中通过 req.Context() 获取
+func UserFromContext(ctx context.Context) (string, bool) {
+	user, ok := ctx.Value(userContextKey).(string)
+	return user, ok
+}
+
+func withUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+// Socks4UserIDFromContext 返回 SOCKS4 请求中的 USERID, 由客户端任意填写, 没有经过认证, 不能用于访问控制
+func Socks4UserIDFromContext(ctx context.Context) (string, bool) {
+	userID, ok := ctx.Value(socks4UserIDContextKey).(string)
+	return userID, ok
+}
@@ -0,0 +1,148 @@
+package socksmitm_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lomoalbert/socksmitm"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	data := "# users\nalice:" + string(hash) + "\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\ncarol:plain\n" +
+		// htpasswd -m / openssl passwd -apr1
+		"erin:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\nfrank:$apr1$8sFt66rZ$W2FL3oYqsNugEfuvgC7LZ0\n"
+	err = os.WriteFile(path, []byte(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := socksmitm.NewHtpasswdAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", true},
+		{"carol", "plain", true},
+		{"erin", "myPassword", true},
+		{"erin", "mypassword", false},
+		{"frank", "a much longer password than sixteen bytes", true},
+		{"dave", "", false},
+	}
+	for _, c := range cases {
+		if auth.Authenticate(c.username, c.password) != c.ok {
+			t.Errorf("Authenticate(%q, %q) != %v", c.username, c.password, c.ok)
+		}
+	}
+}
+
+func TestHtpasswdAuthenticator_UnsupportedHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	err := os.WriteFile(path, []byte("alice:$6$salt$hash\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = socksmitm.NewHtpasswdAuthenticator(path); err == nil {
+		t.Error("sha512-crypt hash accepted")
+	}
+}
+
+func TestServer_SocksAuth(t *testing.T) {
+	server := &socksmitm.Server{Authenticator: socksmitm.StaticAuthenticator{"alice": "secret"}}
+
+	client, conn := net.Pipe()
+	go server.SocksHandle(conn)
+	client.Write([]byte{0x05, 0x01, 0x00})
+	reply := make([]byte, 2)
+	io.ReadFull(client, reply)
+	if !bytes.Equal(reply, []byte{0x05, 0xFF}) {
+		t.Errorf("no auth offered: %x", reply)
+	}
+	client.Close()
+
+	client, conn = net.Pipe()
+	go server.SocksHandle(conn)
+	client.Write([]byte{0x05, 0x02, 0x00, 0x02})
+	io.ReadFull(client, reply)
+	if !bytes.Equal(reply, []byte{0x05, 0x02}) {
+		t.Errorf("method selection: %x", reply)
+	}
+	client.Write(append(append([]byte{0x01, 0x05}, "alice"...), append([]byte{0x05}, "wrong"...)...))
+	io.ReadFull(client, reply)
+	if !bytes.Equal(reply, []byte{0x01, 0x01}) {
+		t.Errorf("wrong password: %x", reply)
+	}
+	client.Close()
+}
+
+func TestServer_Socks4RequiresAuth(t *testing.T) {
+	server := &socksmitm.Server{Authenticator: socksmitm.StaticAuthenticator{"alice": "secret"}}
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.SocksHandle(conn)
+	client.Write(append([]byte{0x04, 0x01, 0x00, 0x50, 0x00, 0x00, 0x00, 0x01}, "alice\x00example.com\x00"...))
+	reply := make([]byte, 8)
+	io.ReadFull(client, reply)
+	if reply[1] != 0x5B {
+		t.Errorf("socks4 reply: %x", reply)
+	}
+}
+
+func TestServer_HTTPProxyAuth(t *testing.T) {
+	server := &socksmitm.Server{Authenticator: socksmitm.StaticAuthenticator{"alice": "secret"}}
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.ServeConn(conn)
+	req, err := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("alice", "wrong")
+	req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+	go req.Write(client)
+	resp, err := http.ReadResponse(bufio.NewReader(client), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("status: %d", resp.StatusCode)
+	}
+}
+
+func TestServer_Socks4UserID(t *testing.T) {
+	var user, userID string
+	var authenticated bool
+	server := &socksmitm.Server{Ruleset: func(ctx context.Context, cmd byte, host string, port int) bool {
+		user, authenticated = socksmitm.UserFromContext(ctx)
+		userID, _ = socksmitm.Socks4UserIDFromContext(ctx)
+		return false
+	}}
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.SocksHandle(conn)
+	client.Write(append([]byte{0x04, 0x01, 0x00, 0x50, 0x00, 0x00, 0x00, 0x01}, "alice\x00example.com\x00"...))
+	reply := make([]byte, 8)
+	io.ReadFull(client, reply)
+	if authenticated || user != "" {
+		t.Errorf("unverified socks4 userid treated as authenticated user %q", user)
+	}
+	if userID != "alice" {
+		t.Errorf("socks4 userid %q", userID)
+	}
+}
@@ -0,0 +1,123 @@
+package socksmitm
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// BindTimeout BIND 等待对端连入的时间
+var BindTimeout = 2 * time.Minute
+
+// SocksBind 监听端口并回复 BND.ADDR/BND.PORT, 等待 DST.ADDR 指定的对端连入后发送第二次回复,
+// 之后客户端的数据流与连入的连接对接, 同样经过 TLS/HTTP 嗅探和 Mux 处理
+func (server *Server) SocksBind(ctx context.Context, conn net.Conn) error {
+	//+-------+------+----------+----------+
+	//|  RSV  | ATYP | DST.ADDR | DST.PORT |
+	//+-------+------+----------+----------+
+	//| X'00' |  1   | Variable |    2     |
+	//+-------+------+----------+----------+
+	host, port, err := readSocksAddr(conn)
+	if err != nil {
+		socksFail(conn, ReplyCode(err))
+		return xerrors.Errorf("%w", err)
+	}
+	if _, rep := server.checkTarget(ctx, 0x02, host, port); rep != RepSucceeded {
+		socksFail(conn, rep)
+		return xerrors.Errorf("bind %s:%d rejected: %x", host, port, rep)
+	}
+	expected, err := lookupBindPeer(ctx, host)
+	if err != nil {
+		socksFail(conn, RepHostUnreachable)
+		return xerrors.Errorf("%w", err)
+	}
+
+	listener, err := bindListen(conn)
+	if err != nil {
+		socksFail(conn, RepGeneralFailure)
+		return xerrors.Errorf("%w", err)
+	}
+	defer listener.Close()
+	bndAddr := listener.Addr().(*net.TCPAddr)
+	_, err = conn.Write(append([]byte{0x05, 0x00, 0x00}, socksAddr(bndAddr.IP.String(), bndAddr.Port)...))
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+
+	peerConn, err := bindAccept(listener, expected)
+	if err != nil {
+		socksFail(conn, ReplyCode(err))
+		return xerrors.Errorf("%w", err)
+	}
+	defer peerConn.Close()
+
+	peerAddr := peerConn.RemoteAddr().(*net.TCPAddr)
+	_, err = conn.Write(append([]byte{0x05, 0x00, 0x00}, socksAddr(peerAddr.IP.String(), peerAddr.Port)...))
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	server.serveStream(withUpstreamConn(ctx, peerConn, ""), conn, peerAddr.IP.String(), peerAddr.Port)
+	return nil
+}
+
+// lookupBindPeer 解析允许连入的对端地址, 返回空表示不限制
+func lookupBindPeer(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsUnspecified() {
+			return nil, nil
+		}
+		return []net.IP{ip}, nil
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	return ips, nil
+}
+
+// bindListen 在客户端连入的本地地址上监听随机端口
+func bindListen(conn net.Conn) (*net.TCPListener, error) {
+	var localIP net.IP
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = addr.IP
+	}
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: localIP})
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	return listener, nil
+}
+
+// bindAccept 等待 expected 中的对端连入, 其他连接直接关闭, 返回后关闭监听
+func bindAccept(listener *net.TCPListener, expected []net.IP) (*net.TCPConn, error) {
+	defer listener.Close()
+	err := listener.SetDeadline(time.Now().Add(BindTimeout))
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	for {
+		peerConn, err := listener.AcceptTCP()
+		if err != nil {
+			return nil, xerrors.Errorf("%w", err)
+		}
+		if containsIP(expected, peerConn.RemoteAddr().(*net.TCPAddr).IP) {
+			return peerConn, nil
+		}
+		peerConn.Close()
+	}
+}
+
+// containsIP ips 为空时不限制
+func containsIP(ips []net.IP, ip net.IP) bool {
+	if len(ips) == 0 {
+		return true
+	}
+	for _, item := range ips {
+		if item.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
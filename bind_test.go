@@ -0,0 +1,59 @@
+package socksmitm_test
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/lomoalbert/socksmitm"
+	"golang.org/x/net/proxy"
+)
+
+func TestServer_SocksBind(t *testing.T) {
+	ca, key := newTestCA(t)
+	server, err := socksmitm.NewSocks5ServerWithCA(socksmitm.NewMux(proxy.Direct), ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", startTestServer(t, server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{0x05, 0x01, 0x00})
+	reply := make([]byte, 10)
+	io.ReadFull(conn, reply[:2])
+	conn.Write([]byte{0x05, 0x02, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+	_, err = io.ReadFull(conn, reply)
+	if err != nil || reply[1] != socksmitm.RepSucceeded || reply[3] != 0x01 {
+		t.Fatalf("first reply %x %v", reply, err)
+	}
+	bndAddr := net.JoinHostPort(net.IP(reply[4:8]).String(), strconv.Itoa(int(reply[8])<<8|int(reply[9])))
+
+	peer, err := net.Dial("tcp", bndAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	_, err = io.ReadFull(conn, reply)
+	if err != nil || reply[1] != socksmitm.RepSucceeded {
+		t.Fatalf("second reply %x %v", reply, err)
+	}
+	peerAddr := peer.LocalAddr().(*net.TCPAddr)
+	if !net.IP(reply[4:8]).Equal(peerAddr.IP) || int(reply[8])<<8|int(reply[9]) != peerAddr.Port {
+		t.Errorf("second reply %x, peer %s", reply, peerAddr)
+	}
+
+	conn.Write([]byte("\x00\x01hello"))
+	buff := make([]byte, 7)
+	_, err = io.ReadFull(peer, buff)
+	if err != nil || string(buff) != "\x00\x01hello" {
+		t.Errorf("peer got %q %v", buff, err)
+	}
+	peer.Write([]byte("world"))
+	_, err = io.ReadFull(conn, buff[:5])
+	if err != nil || string(buff[:5]) != "world" {
+		t.Errorf("client got %q %v", buff[:5], err)
+	}
+}
@@ -0,0 +1,188 @@
+package socksmitm
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"math/big"
+	"os"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// RootCAValidity 新生成的根证书的有效期
+var RootCAValidity = 10 * 365 * 24 * time.Hour
+
+// ParseCertificatePEM 返回 PEM 数据中的第一个证书
+func ParseCertificatePEM(data []byte) (*x509.Certificate, error) {
+	certs, err := ParseCertificatesPEM(data)
+	if err != nil {
+		return nil, err
+	}
+	return certs[0], nil
+}
+
+// ParseCertificatesPEM 按顺序返回 PEM 数据中的所有证书
+func ParseCertificatesPEM(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, xerrors.Errorf("%w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, xerrors.New("no CERTIFICATE block in pem data")
+	}
+	return certs, nil
+}
+
+// ParsePrivateKeyPEM 返回 PEM 数据中的第一个私钥, 支持 PKCS#1 (RSA PRIVATE KEY), PKCS#8 (PRIVATE KEY) 和 SEC1 (EC PRIVATE KEY)
+func ParsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, xerrors.New("no private key block in pem data")
+		}
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("%s: %w", block.Type, err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, xerrors.Errorf("unsupported private key: %T", key)
+		}
+		return signer, nil
+	}
+}
+
+// GenerateRootCA 生成自签名的根证书, 只能用于签发证书
+func GenerateRootCA(commonName string, alg KeyAlgorithm) (*x509.Certificate, crypto.Signer, error) {
+	key, err := GenerateKey(alg)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("%w", err)
+	}
+	template := caTemplate(commonName, RootCAValidity)
+	cert, err := createCA(template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("%w", err)
+	}
+	return cert, key, nil
+}
+
+// GenerateIntermediateCA 用根证书签发有效期为 validity 的中间证书, 根证书可以离线保存, 服务器只使用中间证书签发
+func GenerateIntermediateCA(root *x509.Certificate, rootKey crypto.Signer, commonName string, alg KeyAlgorithm, validity time.Duration) (*x509.Certificate, crypto.Signer, error) {
+	key, err := GenerateKey(alg)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("%w", err)
+	}
+	template := caTemplate(commonName, validity)
+	template.MaxPathLenZero = true // 中间证书只能签发叶子证书
+	if template.NotAfter.After(root.NotAfter) {
+		template.NotAfter = root.NotAfter
+	}
+	cert, err := createCA(template, root, key.Public(), rootKey)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("%w", err)
+	}
+	return cert, key, nil
+}
+
+func caTemplate(commonName string, validity time.Duration) *x509.Certificate {
+	now := time.Now().UTC()
+	return &x509.Certificate{
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{commonName}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+}
+
+func createCA(template, parent *x509.Certificate, publicKey crypto.PublicKey, parentKey crypto.Signer) (*x509.Certificate, error) {
+	var err error
+	template.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	template.SubjectKeyId, err = subjectKeyId(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, publicKey, parentKey)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	return cert, nil
+}
+
+// LoadOrCreateRootCA 读取 PEM 格式的根证书和私钥, 两个文件都不存在时生成 RSA-2048 根证书并写入磁盘
+func LoadOrCreateRootCA(certPath, keyPath, commonName string) (*x509.Certificate, crypto.Signer, error) {
+	certPEM, certErr := os.ReadFile(certPath)
+	keyPEM, keyErr := os.ReadFile(keyPath)
+	if errors.Is(certErr, fs.ErrNotExist) && errors.Is(keyErr, fs.ErrNotExist) {
+		cert, key, err := GenerateRootCA(commonName, KeyRSA2048)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("%w", err)
+		}
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("%w", err)
+		}
+		err = writeFileAtomic(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("%w", err)
+		}
+		err = writeFileAtomic(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o644)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("%w", err)
+		}
+		return cert, key, nil
+	}
+	if certErr != nil {
+		return nil, nil, xerrors.Errorf("%w", certErr)
+	}
+	if keyErr != nil {
+		return nil, nil, xerrors.Errorf("%w", keyErr)
+	}
+	cert, err := ParseCertificatePEM(certPEM)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("%s: %w", certPath, err)
+	}
+	key, err := ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("%s: %w", keyPath, err)
+	}
+	return cert, key, nil
+}
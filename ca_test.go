@@ -0,0 +1,233 @@
+package socksmitm_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lomoalbert/socksmitm"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestLoadOrCreateRootCA(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "rootca.pem"), filepath.Join(dir, "rootca.key")
+	ca, key, err := socksmitm.LoadOrCreateRootCA(certPath, keyPath, "socksmitm test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.IsCA || ca.KeyUsage&x509.KeyUsageCertSign == 0 || len(ca.SubjectKeyId) == 0 {
+		t.Errorf("root ca constraints: IsCA=%v KeyUsage=%v", ca.IsCA, ca.KeyUsage)
+	}
+	loaded, loadedKey, err := socksmitm.LoadOrCreateRootCA(certPath, keyPath, "socksmitm test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Equal(ca) {
+		t.Error("second call generated a new root ca")
+	}
+	if _, err = socksmitm.NewSocks5ServerWithCA(nil, loaded, loadedKey); err != nil {
+		t.Error(err)
+	}
+	otherCA, _ := newTestCA(t)
+	if _, err = socksmitm.NewSocks5ServerWithCA(nil, otherCA, key); err == nil {
+		t.Error("mismatched key accepted")
+	}
+}
+
+func TestNewSocks5ServerFromPEM(t *testing.T) {
+	certPEM := func(cert *x509.Certificate) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	rsaCA, rsaKey := newTestCA(t)
+	ecCA, ecKey, err := socksmitm.GenerateRootCA("ec test", socksmitm.KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec1, err := x509.MarshalECPrivateKey(ecKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string][2][]byte{
+		"pkcs1": {certPEM(rsaCA), pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})},
+		"pkcs8": {certPEM(rsaCA), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})},
+		"sec1":  {certPEM(ecCA), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1})},
+	}
+	for name, c := range cases {
+		if _, err := socksmitm.NewSocks5ServerFromPEM(nil, c[0], c[1]); err != nil {
+			t.Errorf("%s: %+v", name, err)
+		}
+	}
+}
+
+func TestNewSocks5Server_ModernPKCS12(t *testing.T) {
+	ca, key := newTestCA(t)
+	pfx, err := pkcs12.Modern.Encode(key, ca, nil, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = socksmitm.NewSocks5Server(nil, pfx, "secret")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+}
+
+func TestIntermediateCA(t *testing.T) {
+	root, rootKey, err := socksmitm.GenerateRootCA("offline root", socksmitm.KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediate, intermediateKey, err := socksmitm.GenerateIntermediateCA(root, rootKey, "signing ca", socksmitm.KeyECDSAP256, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = socksmitm.NewSocks5ServerWithCA(nil, intermediate, intermediateKey, root); err != nil {
+		t.Fatal(err)
+	}
+	otherCA, _ := newTestCA(t)
+	if _, err = socksmitm.NewSocks5ServerWithCA(nil, intermediate, intermediateKey, otherCA); err == nil {
+		t.Error("broken chain accepted")
+	}
+
+	leafKey, err := socksmitm.GenerateKey(socksmitm.KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := socksmitm.GenMITMTLSConfigWithKey(intermediate, intermediateKey, "example.test", leafKey, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := config.Certificates[0]
+	if len(cert.Certificate) != 3 {
+		t.Fatalf("chain length %d", len(cert.Certificate))
+	}
+	leaf := cert.Leaf
+	if leaf == nil || leaf.IsCA || leaf.VerifyHostname("www.example.test") != nil {
+		t.Fatalf("Leaf is not the issued certificate: %v", leaf)
+	}
+	if !bytes.Equal(leaf.AuthorityKeyId, intermediate.SubjectKeyId) || len(leaf.SubjectKeyId) == 0 {
+		t.Errorf("AuthorityKeyId %x, SubjectKeyId %x", leaf.AuthorityKeyId, leaf.SubjectKeyId)
+	}
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	roots.AddCert(root)
+	for _, der := range cert.Certificate[1:] {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		intermediates.AddCert(c)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: "example.test", Roots: roots, Intermediates: intermediates})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewSocks5ServerWithCA_NotCA(t *testing.T) {
+	key, err := socksmitm.GenerateKey(socksmitm.KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "not a ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = socksmitm.NewSocks5ServerWithCA(nil, leaf, key)
+	if !errors.Is(err, socksmitm.ErrNotCA) {
+		t.Errorf("NewSocks5ServerWithCA(leaf) = %v, want ErrNotCA", err)
+	}
+	_, err = socksmitm.NewSocks5ServerFromPEM(nil, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), mustKeyPEM(t, key))
+	if !errors.Is(err, socksmitm.ErrNotCA) {
+		t.Errorf("NewSocks5ServerFromPEM(leaf) = %v, want ErrNotCA", err)
+	}
+}
+
+func mustKeyPEM(t *testing.T, key interface{}) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func TestIntermediateCA_ChainOrder(t *testing.T) {
+	root, rootKey, err := socksmitm.GenerateRootCA("offline root", socksmitm.KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, policyKey, err := socksmitm.GenerateIntermediateCA(root, rootKey, "policy ca", socksmitm.KeyECDSAP256, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signing, signingKey, err := socksmitm.GenerateIntermediateCA(policy, policyKey, "signing ca", socksmitm.KeyECDSAP256, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]struct {
+		chain []*x509.Certificate
+		want  []*x509.Certificate
+	}{
+		"ordered":  {[]*x509.Certificate{policy, root}, []*x509.Certificate{signing, policy, root}},
+		"shuffled": {[]*x509.Certificate{root, policy}, []*x509.Certificate{signing, policy, root}},
+		"no root":  {[]*x509.Certificate{policy}, []*x509.Certificate{signing, policy}},
+	}
+	for name, c := range cases {
+		pfx, err := pkcs12.Modern.Encode(signingKey, signing, c.chain, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := socksmitm.NewSocks5Server(nil, pfx, "secret")
+		if err != nil {
+			t.Errorf("%s: %+v", name, err)
+			continue
+		}
+		var hello tls.ClientHelloInfo
+		config, err := server.GenFuncGetConfigForTarget(&hello, "example.test")(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := config.Certificates[0].Certificate[1:]
+		if len(got) != len(c.want) {
+			t.Errorf("%s: chain length %d, want %d", name, len(got), len(c.want))
+			continue
+		}
+		for i, cert := range c.want {
+			if !bytes.Equal(got[i], cert.Raw) {
+				t.Errorf("%s: chain[%d] is not %s", name, i, cert.Subject)
+			}
+		}
+	}
+	otherCA, _ := newTestCA(t)
+	pfx, err := pkcs12.Modern.Encode(signingKey, signing, []*x509.Certificate{otherCA, root}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = socksmitm.NewSocks5Server(nil, pfx, "secret"); err == nil {
+		t.Error("chain without the issuing ca accepted")
+	}
+}
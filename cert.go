@@ -1,11 +1,14 @@
 package socksmitm
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"math/big"
 	"net"
 	"time"
@@ -14,14 +17,19 @@ import (
 )
 
 func GenMITMTLSConfig(rootCa *x509.Certificate, rootPrivateKey interface{}, dnsName string) (config *tls.Config, err error) {
-	now := time.Now().Add(-1 * time.Hour).UTC()
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	//生成公钥私钥对
+	priKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		return nil, xerrors.Errorf("%w", err)
 	}
+	return GenMITMTLSConfigWithKey(rootCa, rootPrivateKey, dnsName, priKey)
+}
+
+// GenMITMTLSConfigWithKey 使用给定的私钥 (RSA, ECDSA 或 Ed25519) 签发 dnsName 的证书
+// rootCa 可以是中间证书, chain 为 rootCa 之上需要发送给客户端的证书
+func GenMITMTLSConfigWithKey(rootCa *x509.Certificate, rootPrivateKey interface{}, dnsName string, priKey crypto.Signer, chain ...*x509.Certificate) (config *tls.Config, err error) {
+	now := time.Now().Add(-1 * time.Hour).UTC()
 	equiCer := &x509.Certificate{
-		SerialNumber: serialNumber, //证书序列号
 		Subject: pkix.Name{
 			Country:            []string{"CN"},
 			Organization:       []string{"Easy"},
@@ -43,13 +51,64 @@ func GenMITMTLSConfig(rootCa *x509.Certificate, rootPrivateKey interface{}, dnsN
 	} else {
 		equiCer.DNSNames = []string{dnsName, "*." + dnsName}
 	}
-	//生成公钥私钥对
-	priKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	return signMITMCert(rootCa, rootPrivateKey, equiCer, priKey, chain)
+}
+
+// GenMimicTLSConfig 复制上游证书的 Subject, SAN, 有效期和用途, 用根证书重新签发
+// 上游证书已过期时使用默认的有效期; 上游证书不包含 dnsName 时把 dnsName 加入 SAN
+func GenMimicTLSConfig(rootCa *x509.Certificate, rootPrivateKey interface{}, upstream *x509.Certificate, dnsName string, priKey crypto.Signer, chain ...*x509.Certificate) (config *tls.Config, err error) {
+	now := time.Now().Add(-1 * time.Hour).UTC()
+	equiCer := &x509.Certificate{
+		Subject:               upstream.Subject,
+		DNSNames:              append([]string(nil), upstream.DNSNames...),
+		IPAddresses:           append([]net.IP(nil), upstream.IPAddresses...),
+		URIs:                  upstream.URIs,
+		EmailAddresses:        upstream.EmailAddresses,
+		NotBefore:             upstream.NotBefore,
+		NotAfter:              upstream.NotAfter,
+		BasicConstraintsValid: true,
+		MaxPathLen:            -1,
+		ExtKeyUsage:           upstream.ExtKeyUsage,
+		KeyUsage:              upstream.KeyUsage,
+	}
+	if time.Now().After(upstream.NotAfter) {
+		equiCer.NotBefore = now.Add(-time.Hour)
+		equiCer.NotAfter = now.AddDate(1, 0, 0)
+	}
+	if dnsName != "" && upstream.VerifyHostname(dnsName) != nil {
+		if ip := net.ParseIP(dnsName); ip != nil {
+			equiCer.IPAddresses = append(equiCer.IPAddresses, ip)
+		} else {
+			equiCer.DNSNames = append(equiCer.DNSNames, dnsName)
+		}
+	}
+	if len(equiCer.ExtKeyUsage) == 0 {
+		equiCer.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	if equiCer.KeyUsage == 0 {
+		equiCer.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	}
+	return signMITMCert(rootCa, rootPrivateKey, equiCer, priKey, chain)
+}
+
+// signMITMCert 填入随机序列号和 SubjectKeyId, 用 rootCa 签发 equiCer, 证书链为 leaf, rootCa, chain...
+// AuthorityKeyId 由 x509.CreateCertificate 从 rootCa.SubjectKeyId 填入
+func signMITMCert(rootCa *x509.Certificate, rootPrivateKey interface{}, equiCer *x509.Certificate, priKey crypto.Signer, chain []*x509.Certificate) (config *tls.Config, err error) {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
 		return nil, xerrors.Errorf("%w", err)
 	}
+	equiCer.SerialNumber = serialNumber //证书序列号
+	if _, ok := priKey.Public().(*rsa.PublicKey); !ok {
+		equiCer.KeyUsage &^= x509.KeyUsageKeyEncipherment // 只有 RSA 密钥交换需要 KeyEncipherment
+	}
+	equiCer.SubjectKeyId, err = subjectKeyId(priKey.Public())
+	if err != nil {
+		return nil, err
+	}
 
-	x, err := x509.CreateCertificate(rand.Reader, equiCer, rootCa, &priKey.PublicKey, rootPrivateKey)
+	x, err := x509.CreateCertificate(rand.Reader, equiCer, rootCa, priKey.Public(), rootPrivateKey)
 	if err != nil {
 		return nil, xerrors.Errorf("%w", err)
 	}
@@ -76,11 +135,35 @@ func GenMITMTLSConfig(rootCa *x509.Certificate, rootPrivateKey interface{}, dnsN
 	//cer.Certificate = append(cer.Certificate, )
 	cert := tls.Certificate{}
 	cert.Certificate = append(cert.Certificate, x, rootCa.Raw)
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
 	cert.PrivateKey = priKey
-	cert.Leaf = rootCa
+	cert.Leaf, err = x509.ParseCertificate(x)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
 	config = &tls.Config{
 		Certificates: []tls.Certificate{cert},
-		//NextProtos:   []string{"h2", "http/1.1"},
+		NextProtos:   []string{"h2", "http/1.1"},
 	}
 	return config, nil
 }
+
+// subjectKeyId RFC 5280 4.2.1.2 方法 1: 公钥的 SHA-1
+func subjectKeyId(publicKey crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	_, err = asn1.Unmarshal(der, &spki)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	sum := sha1.Sum(spki.PublicKey.Bytes)
+	return sum[:], nil
+}
@@ -1,12 +1,25 @@
 package socksmitm_test
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/lomoalbert/socksmitm"
 	"golang.org/x/crypto/pkcs12"
+	"golang.org/x/net/proxy"
 )
 
 func TestServer_Run(t *testing.T) {
@@ -29,3 +42,269 @@ func TestServer_Run(t *testing.T) {
 		log.Println(cert.PrivateKey)
 	}
 }
+
+func newTestCA(t *testing.T) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "socksmitm test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, key
+}
+
+func TestGenMITMTLSConfig_IPv6(t *testing.T) {
+	ca, key := newTestCA(t)
+	config, err := socksmitm.GenMITMTLSConfig(ca, key, "2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaf.IPAddresses) != 1 || !leaf.IPAddresses[0].Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("IPAddresses: %v", leaf.IPAddresses)
+	}
+	err = leaf.VerifyHostname("2001:db8::1")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGenMimicTLSConfig(t *testing.T) {
+	ca, caKey := newTestCA(t)
+	upstreamURL, _ := url.Parse("spiffe://example.test/web")
+	upstream := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "www.example.test", Organization: []string{"Example Inc"}},
+		DNSNames:    []string{"www.example.test", "example.test"},
+		IPAddresses: []net.IP{net.ParseIP("192.0.2.1")},
+		URIs:        []*url.URL{upstreamURL},
+		NotBefore:   time.Now().Add(-24 * time.Hour).Truncate(time.Second),
+		NotAfter:    time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	key, err := socksmitm.GenerateKey(socksmitm.KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := socksmitm.GenMimicTLSConfig(ca, caKey, upstream, "cdn.example.test", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = leaf.CheckSignatureFrom(ca); err != nil {
+		t.Error(err)
+	}
+	if leaf.Subject.String() != upstream.Subject.String() {
+		t.Errorf("Subject: %s", leaf.Subject)
+	}
+	if !leaf.NotBefore.Equal(upstream.NotBefore) || !leaf.NotAfter.Equal(upstream.NotAfter) {
+		t.Errorf("validity: %s - %s", leaf.NotBefore, leaf.NotAfter)
+	}
+	if len(leaf.DNSNames) != 3 || len(leaf.IPAddresses) != 1 || len(leaf.URIs) != 1 || leaf.URIs[0].String() != upstreamURL.String() {
+		t.Errorf("SAN: %v %v %v", leaf.DNSNames, leaf.IPAddresses, leaf.URIs)
+	}
+	if err = leaf.VerifyHostname("cdn.example.test"); err != nil {
+		t.Error(err)
+	}
+	if len(upstream.DNSNames) != 2 {
+		t.Errorf("upstream modified: %v", upstream.DNSNames)
+	}
+}
+
+func TestServer_MimicUpstreamPort(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.NotFoundHandler())
+	defer upstream.Close()
+	upstreamLeaf := upstream.Certificate()
+	_, portStr, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	ca, key := newTestCA(t)
+	server, err := socksmitm.NewSocks5ServerWithCA(socksmitm.NewMux(proxy.Direct), ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.MimicUpstream = true
+	var hello tls.ClientHelloInfo
+	config, err := server.GenFuncGetConfigForTargetPort(&hello, "127.0.0.1", port)(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := config.Certificates[0].Leaf
+	if leaf.Subject.String() != upstreamLeaf.Subject.String() || !leaf.NotAfter.Equal(upstreamLeaf.NotAfter) {
+		t.Errorf("not mimicking upstream on port %d: %s %s", port, leaf.Subject, leaf.NotAfter)
+	}
+}
+
+func TestServer_MimicUpstreamStore(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.NotFoundHandler())
+	upstreamLeaf := upstream.Certificate()
+	_, portStr, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	dir := t.TempDir()
+	ca, key := newTestCA(t)
+	newServer := func() *socksmitm.Server {
+		server, err := socksmitm.NewSocks5ServerWithCA(socksmitm.NewMux(proxy.Direct), ca, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.MimicUpstream = true
+		server.CertStore, err = socksmitm.NewCertStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return server
+	}
+	getLeaf := func(server *socksmitm.Server) *x509.Certificate {
+		var hello tls.ClientHelloInfo
+		config, err := server.GenFuncGetConfigForTargetPort(&hello, "127.0.0.1", port)(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config.Certificates[0].Leaf
+	}
+	getLeaf(newServer())
+	upstream.Close()
+	// 上游关闭后, 新的 Server 从 CertStore 加载之前保存的模仿证书
+	leaf := getLeaf(newServer())
+	if leaf.Subject.String() != upstreamLeaf.Subject.String() {
+		t.Errorf("stored mimic certificate not loaded: %s", leaf.Subject)
+	}
+}
+
+func TestServer_MimicUpstreamFallback(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	defer func(ttl time.Duration) { socksmitm.TemporaryCertTTL = ttl }(socksmitm.TemporaryCertTTL)
+	socksmitm.TemporaryCertTTL = 100 * time.Millisecond
+	dir := t.TempDir()
+	ca, key := newTestCA(t)
+	server, err := socksmitm.NewSocks5ServerWithCA(socksmitm.NewMux(proxy.Direct), ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.MimicUpstream = true
+	server.CertStore, err = socksmitm.NewCertStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func() {
+		var hello tls.ClientHelloInfo
+		_, err := server.GenFuncGetConfigForTargetPort(&hello, "127.0.0.1", port)(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	get()
+	get()
+	if stats := server.CertCache().Stats(); stats.Generated != 1 {
+		t.Errorf("fallback generated %d times before ttl", stats.Generated)
+	}
+	time.Sleep(200 * time.Millisecond)
+	get()
+	if stats := server.CertCache().Stats(); stats.Generated != 2 {
+		t.Errorf("fallback generated %d times after ttl", stats.Generated)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil || len(files) != 0 {
+		t.Errorf("fallback certificate stored: %d %v", len(files), err)
+	}
+}
+
+func TestMainDomain(t *testing.T) {
+	cases := map[string]string{
+		"www.example.com":   "example.com",
+		"a.b.example.co.uk": "example.co.uk",
+		"Example.COM.":      "example.com",
+		"foo.github.io":     "foo.github.io",
+		"co.uk":             "co.uk",
+		"192.0.2.1":         "192.0.2.1",
+		"2001:db8::1":       "2001:db8::1",
+		"":                  "",
+	}
+	for domain, mainDomain := range cases {
+		if got := socksmitm.MainDomain(domain); got != mainDomain {
+			t.Errorf("MainDomain(%q) = %q, want %q", domain, got, mainDomain)
+		}
+	}
+}
+
+func TestServer_GenFuncGetConfigForTarget(t *testing.T) {
+	ca, key := newTestCA(t)
+	server, err := socksmitm.NewSocks5ServerWithCA(nil, ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		serverName string
+		host       string
+		verify     string
+	}{
+		{"", "192.0.2.7", "192.0.2.7"},
+		{"", "2001:db8::7", "2001:db8::7"},
+		{"", "www.example.test", "www.example.test"},
+		{"api.example.test", "192.0.2.7", "api.example.test"},
+	}
+	for _, c := range cases {
+		var hello tls.ClientHelloInfo
+		config, err := server.GenFuncGetConfigForTarget(&hello, c.host)(&tls.ClientHelloInfo{ServerName: c.serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = config.Certificates[0].Leaf.VerifyHostname(c.verify); err != nil {
+			t.Errorf("sni %q host %q: %v", c.serverName, c.host, err)
+		}
+	}
+}
+
+func TestServer_NoWildcard(t *testing.T) {
+	ca, key := newTestCA(t)
+	server, err := socksmitm.NewSocks5ServerWithCA(nil, ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.NoWildcard = func(host string) bool {
+		return host == "strict.example.test"
+	}
+	leaf := func(serverName string) *x509.Certificate {
+		var hello tls.ClientHelloInfo
+		config, err := server.GenFuncGetConfigForTarget(&hello, "192.0.2.1")(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config.Certificates[0].Leaf
+	}
+	a, b, strict := leaf("a.example.test"), leaf("b.example.test"), leaf("strict.example.test")
+	if a.SerialNumber.Cmp(b.SerialNumber) != 0 || a.VerifyHostname("b.example.test") != nil {
+		t.Errorf("siblings do not share the wildcard certificate: %v %v", a.DNSNames, b.DNSNames)
+	}
+	if strict.SerialNumber.Cmp(a.SerialNumber) == 0 || strict.VerifyHostname("a.example.test") == nil {
+		t.Errorf("opted-out host got the wildcard certificate: %v", strict.DNSNames)
+	}
+	if err = strict.VerifyHostname("strict.example.test"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,176 @@
+package socksmitm
+
+import (
+	"container/list"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// CertCacheSize 默认最多缓存的证书数量
+var CertCacheSize = 1024
+
+// CertRenewBefore 默认在证书过期前多久重新生成
+var CertRenewBefore = 24 * time.Hour
+
+// TemporaryCertTTL 临时证书的缓存时间, 如 MimicUpstream 取不到上游证书时生成的默认证书, 过期后重新生成
+var TemporaryCertTTL = time.Minute
+
+// errTemporaryCert generate 与证书一起返回, 表示证书可以使用但只缓存 TemporaryCertTTL
+var errTemporaryCert = xerrors.New("temporary certificate")
+
+// CertCacheStats 证书缓存的统计信息, GenerateTime 为生成证书的总耗时
+type CertCacheStats struct {
+	Size         int
+	Hits         uint64
+	Misses       uint64
+	Renewed      uint64
+	Evicted      uint64
+	Generated    uint64
+	Failed       uint64
+	GenerateTime time.Duration
+}
+
+// CertCache 并发安全的证书缓存: 同一主机并发请求只生成一次, 超过 Size 时淘汰最久未使用的证书, 快过期时重新生成
+type CertCache struct {
+	// Size 小于等于 0 时使用 CertCacheSize
+	Size int
+	// RenewBefore 小于等于 0 时使用 CertRenewBefore
+	RenewBefore time.Duration
+	generate    func(name string) (*tls.Config, error)
+	mutex       sync.Mutex
+	entries     map[string]*list.Element
+	lru         *list.List
+	calls       map[string]*certCall
+	stats       CertCacheStats
+}
+
+type certEntry struct {
+	name     string
+	config   *tls.Config
+	notAfter time.Time
+	// expires 临时证书的过期时间, 其它证书为零值
+	expires time.Time
+}
+
+// certCall 正在生成的证书, 同一主机的其它请求等待 done
+type certCall struct {
+	done   chan struct{}
+	config *tls.Config
+	err    error
+}
+
+func NewCertCache(generate func(name string) (*tls.Config, error)) *CertCache {
+	return &CertCache{
+		generate: generate,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		calls:    make(map[string]*certCall),
+	}
+}
+
+// Get 返回 name 的证书配置, 不存在或快过期时生成
+func (c *CertCache) Get(name string) (*tls.Config, error) {
+	c.mutex.Lock()
+	if element, ok := c.entries[name]; ok {
+		entry := element.Value.(*certEntry)
+		now := time.Now()
+		if now.Before(entry.notAfter.Add(-c.renewBefore())) && (entry.expires.IsZero() || now.Before(entry.expires)) {
+			c.lru.MoveToFront(element)
+			c.stats.Hits++
+			c.mutex.Unlock()
+			return entry.config, nil
+		}
+		c.lru.Remove(element)
+		delete(c.entries, name)
+		c.stats.Renewed++
+	}
+	c.stats.Misses++
+	if call, ok := c.calls[name]; ok {
+		c.mutex.Unlock()
+		<-call.done
+		return call.config, call.err
+	}
+	call := &certCall{done: make(chan struct{})}
+	c.calls[name] = call
+	c.mutex.Unlock()
+
+	start := time.Now()
+	call.config, call.err = c.generate(name)
+	elapsed := time.Since(start)
+	var notAfter, expires time.Time
+	if errors.Is(call.err, errTemporaryCert) {
+		call.err = nil
+		expires = time.Now().Add(TemporaryCertTTL)
+	}
+	if call.err == nil {
+		notAfter, call.err = configNotAfter(call.config)
+	}
+
+	c.mutex.Lock()
+	delete(c.calls, name)
+	c.stats.GenerateTime += elapsed
+	if call.err != nil {
+		c.stats.Failed++
+	} else {
+		c.stats.Generated++
+		c.entries[name] = c.lru.PushFront(&certEntry{name: name, config: call.config, notAfter: notAfter, expires: expires})
+		for c.lru.Len() > c.size() {
+			oldest := c.lru.Back()
+			c.lru.Remove(oldest)
+			delete(c.entries, oldest.Value.(*certEntry).name)
+			c.stats.Evicted++
+		}
+	}
+	c.mutex.Unlock()
+	close(call.done)
+	return call.config, call.err
+}
+
+// Remove 删除 name 的证书, 下次请求时重新生成
+func (c *CertCache) Remove(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[name]; ok {
+		c.lru.Remove(element)
+		delete(c.entries, name)
+	}
+}
+
+func (c *CertCache) Stats() CertCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats
+	stats.Size = c.lru.Len()
+	return stats
+}
+
+func (c *CertCache) size() int {
+	if c.Size <= 0 {
+		return CertCacheSize
+	}
+	return c.Size
+}
+
+func (c *CertCache) renewBefore() time.Duration {
+	if c.RenewBefore <= 0 {
+		return CertRenewBefore
+	}
+	return c.RenewBefore
+}
+
+// configNotAfter 返回配置中第一个证书的过期时间
+func configNotAfter(config *tls.Config) (time.Time, error) {
+	if len(config.Certificates) == 0 || len(config.Certificates[0].Certificate) == 0 {
+		return time.Time{}, xerrors.New("tls config without certificate")
+	}
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		return time.Time{}, xerrors.Errorf("%w", err)
+	}
+	return cert.NotAfter, nil
+}
@@ -0,0 +1,69 @@
+package socksmitm_test
+
+import (
+	"crypto/tls"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lomoalbert/socksmitm"
+)
+
+func TestCertCache(t *testing.T) {
+	ca, key := newTestCA(t)
+	var generated int32
+	cache := socksmitm.NewCertCache(func(name string) (*tls.Config, error) {
+		atomic.AddInt32(&generated, 1)
+		return socksmitm.GenMITMTLSConfig(ca, key, name)
+	})
+	cache.Size = 2
+
+	var wg sync.WaitGroup
+	configs := make([]*tls.Config, 8)
+	for i := range configs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			config, err := cache.Get("a.test")
+			if err != nil {
+				t.Error(err)
+			}
+			configs[i] = config
+		}(i)
+	}
+	wg.Wait()
+	if generated != 1 {
+		t.Fatalf("generated %d certs for one host", generated)
+	}
+	for _, config := range configs {
+		if config != configs[0] {
+			t.Fatal("concurrent Get returned different configs")
+		}
+	}
+
+	cache.Get("b.test")
+	cache.Get("a.test")
+	cache.Get("c.test") // 淘汰最久未使用的 b.test
+	cache.Get("a.test")
+	if generated != 3 {
+		t.Fatalf("generated %d, a.test should still be cached", generated)
+	}
+	cache.Get("b.test")
+	if generated != 4 {
+		t.Fatalf("generated %d, b.test should have been evicted", generated)
+	}
+
+	stats := cache.Stats()
+	if stats.Size != 2 || stats.Evicted != 2 || stats.Generated != 4 || stats.Hits == 0 || stats.GenerateTime <= 0 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	// 证书有效期一年, 提前两年续期时每次都重新生成
+	cache.RenewBefore = 2 * 365 * 24 * time.Hour
+	first, _ := cache.Get("b.test")
+	second, _ := cache.Get("b.test")
+	if first == second || cache.Stats().Renewed != 2 {
+		t.Errorf("expired cert was not renewed: %+v", cache.Stats())
+	}
+}
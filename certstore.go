@@ -0,0 +1,164 @@
+package socksmitm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+var errStaleCert = xerrors.New("stored certificate is expired or not signed by the current root")
+
+// CertStore 把生成的证书和私钥按主机名保存为 PEM 文件, 重启后继续使用, 客户端看到的证书不变
+type CertStore struct {
+	dir string
+	// RenewBefore 小于等于 0 时使用 CertRenewBefore, 快过期的证书不再加载
+	RenewBefore time.Duration
+}
+
+// NewCertStore dir 不存在时创建
+func NewCertStore(dir string) (*CertStore, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	return &CertStore{dir: dir}, nil
+}
+
+// Load 读取 name 的证书, 文件不存在时返回 fs.ErrNotExist, 证书过期或不是 root 签发的返回错误
+func (store *CertStore) Load(name string, root *x509.Certificate) (*tls.Config, error) {
+	data, err := os.ReadFile(store.path(name))
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, xerrors.Errorf("%s: %w", name, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, xerrors.Errorf("%s: %w", name, err)
+	}
+	if !store.valid(leaf, root) {
+		return nil, xerrors.Errorf("%s: %w", name, errStaleCert)
+	}
+	// MimicUpstream 时 name 是 host:port
+	host := name
+	if h, _, err := net.SplitHostPort(name); err == nil {
+		host = h
+	}
+	if host != "" && leaf.VerifyHostname(host) != nil {
+		return nil, xerrors.Errorf("%s: %w", name, errStaleCert)
+	}
+	cert.Leaf = leaf
+	return &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}}, nil
+}
+
+// Save 保存 config 的第一个证书链和私钥
+func (store *CertStore) Save(name string, config *tls.Config) error {
+	if len(config.Certificates) == 0 {
+		return xerrors.New("tls config without certificate")
+	}
+	cert := config.Certificates[0]
+	var data []byte
+	for _, der := range cert.Certificate {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})...)
+	return writeFileAtomic(store.path(name), data, 0o600)
+}
+
+// Prune 删除过期, 无法解析或不是 root 签发的证书, 返回删除的数量
+func (store *CertStore) Prune(root *x509.Certificate) (int, error) {
+	entries, err := os.ReadDir(store.dir)
+	if err != nil {
+		return 0, xerrors.Errorf("%w", err)
+	}
+	removed := 0
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".pem" {
+			continue
+		}
+		path := filepath.Join(store.dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return removed, xerrors.Errorf("%w", err)
+		}
+		block, _ := pem.Decode(data)
+		if block != nil && block.Type == "CERTIFICATE" {
+			leaf, err := x509.ParseCertificate(block.Bytes)
+			if err == nil && store.valid(leaf, root) {
+				continue
+			}
+		}
+		err = os.Remove(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, xerrors.Errorf("%w", err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func (store *CertStore) valid(leaf, root *x509.Certificate) bool {
+	renewBefore := store.RenewBefore
+	if renewBefore <= 0 {
+		renewBefore = CertRenewBefore
+	}
+	if time.Now().Add(renewBefore).After(leaf.NotAfter) {
+		return false
+	}
+	return leaf.CheckSignatureFrom(root) == nil
+}
+
+// path 主机名中不能用作文件名的字符替换为 _
+func (store *CertStore) path(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(name))
+	if name == "" || strings.Trim(name, ".") == "" {
+		name = "_" + name
+	}
+	return filepath.Join(store.dir, name+".pem")
+}
+
+// writeFileAtomic 先写临时文件再重命名, 避免留下写到一半的文件
+func writeFileAtomic(path string, data []byte, perm fs.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package socksmitm_test
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/lomoalbert/socksmitm"
+)
+
+func TestCertStore(t *testing.T) {
+	ca, key := newTestCA(t)
+	store, err := socksmitm.NewCertStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Load("a.test", ca)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Load missing: %v", err)
+	}
+
+	for _, name := range []string{"a.test", "2001:db8::1"} {
+		config, err := socksmitm.GenMITMTLSConfig(ca, key, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.Save(name, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := store.Load(name, ca)
+		if err != nil {
+			t.Fatalf("Load %s: %+v", name, err)
+		}
+		if string(loaded.Certificates[0].Certificate[0]) != string(config.Certificates[0].Certificate[0]) {
+			t.Errorf("%s: loaded a different certificate", name)
+		}
+	}
+
+	otherCA, _ := newTestCA(t)
+	if _, err = store.Load("a.test", otherCA); err == nil {
+		t.Error("loaded a certificate signed by another root")
+	}
+	if removed, err := store.Prune(ca); err != nil || removed != 0 {
+		t.Errorf("Prune valid certs: %d %v", removed, err)
+	}
+
+	// 证书有效期一年, 提前两年续期时视为过期
+	store.RenewBefore = 2 * 365 * 24 * time.Hour
+	if _, err = store.Load("a.test", ca); err == nil {
+		t.Error("loaded an expiring certificate")
+	}
+	if removed, err := store.Prune(ca); err != nil || removed != 2 {
+		t.Errorf("Prune expiring certs: %d %v", removed, err)
+	}
+}
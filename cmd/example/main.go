@@ -50,6 +50,12 @@ func main() {
 	mux.SetDefaultHTTPRoundTrip(socksmitm.NormalRoundTrip)
 	mux.Register("abc.com", ChangeReqRoundTrip)
 	mux.Register("def.com", ChangeRespRoundTrip)
+	mux.Register("ghi.com", socksmitm.StreamRoundTrip(socksmitm.NormalRoundTrip, &socksmitm.StreamHooks{
+		MaxCapture: 64 << 10,
+		Done: func(exchange *socksmitm.HTTPExchange) {
+			log.Println("resp:", exchange.Request.URL, exchange.Response.Status, len(exchange.ResponseBody), exchange.ResponseTruncated)
+		},
+	}))
 	//mux.Register("genresp.test",TestComRoutdTrip)
 	server, err := socksmitm.NewSocks5Server(mux, pkcs12Data, "DwCpsCLsZc7c")
 	if err != nil {
@@ -100,12 +106,7 @@ func ChangeRespRoundTrip(req *http.Request) (*http.Response, error) {
 	if err != nil {
 		return nil, xerrors.Errorf("%w", err)
 	}
-	orgBody := resp.Body
-	defer orgBody.Close()
-	_, err = io.ReadAll(orgBody)
-	if err != nil {
-		return nil, xerrors.Errorf("%w", err)
-	}
+	resp.Body.Close() // 原 body 不再需要, 不必读完
 	log.Println("orgHeader:", resp.Header, resp.ContentLength)
 	newData := []byte("mitm works!")
 	if resp.Header.Get("Content-Encoding") == "gzip" {
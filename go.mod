@@ -6,6 +6,8 @@ require (
 	golang.org/x/crypto v0.18.0
 	golang.org/x/net v0.20.0
 	golang.org/x/xerrors v0.0.0-20231012003039-104605ab7028
+	google.golang.org/protobuf v1.36.5
+	software.sslmate.com/src/go-pkcs12 v0.5.0
 )
 
 require golang.org/x/text v0.14.0 // indirect
@@ -0,0 +1,306 @@
+package socksmitm
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// GRPCMaxMessageSize 单条 gRPC 消息的最大长度
+var GRPCMaxMessageSize uint32 = 16 << 20
+
+// GRPCMessage 一条 gRPC 消息 (Length-Prefixed-Message), Compressed 为 true 时 Data 为压缩后的数据 (grpc-encoding)
+type GRPCMessage struct {
+	Compressed bool
+	Data       []byte
+	// Response 为 true 表示服务端返回的消息
+	Response bool
+}
+
+// GRPCCall 一次 gRPC 调用, Response 在收到响应头之后才有值, 只应在 Response 钩子和 Done 中使用
+type GRPCCall struct {
+	Service  string
+	Method   string
+	Request  *http.Request
+	Response *http.Response
+}
+
+// FullMethod 返回 /package.Service/Method
+func (call *GRPCCall) FullMethod() string {
+	return "/" + call.Service + "/" + call.Method
+}
+
+// Status 返回 trailer (或 Trailers-Only 响应头) 中的 grpc-status 和 grpc-message, 调用未结束时 ok 为 false
+func (call *GRPCCall) Status() (code int, message string, ok bool) {
+	if call.Response == nil {
+		return 0, "", false
+	}
+	status := call.Response.Trailer.Get("Grpc-Status")
+	message = call.Response.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status = call.Response.Header.Get("Grpc-Status")
+		message = call.Response.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return 0, "", false
+	}
+	if unescaped, err := url.PathUnescape(message); err == nil {
+		message = unescaped
+	}
+	return code, message, true
+}
+
+// GRPCMessageFunc 处理一条消息, 返回的消息按顺序替换原消息: 原样返回 []*GRPCMessage{message} 表示不修改, 返回空表示丢弃
+// 返回 error 时中断该方向的数据流
+type GRPCMessageFunc func(call *GRPCCall, message *GRPCMessage) ([]*GRPCMessage, error)
+
+// GRPCHooks 一个方法或服务的钩子, 字段为 nil 时不处理
+type GRPCHooks struct {
+	Request  GRPCMessageFunc
+	Response GRPCMessageFunc
+	// Done 响应结束后调用, 可以用 call.Status() 获取结果
+	Done func(call *GRPCCall)
+}
+
+// GRPCMux 识别 gRPC 请求 (Content-Type: application/grpc), 逐条消息调用注册的钩子后交给 Next; 其它请求直接交给 Next
+// RoundTrip 可以作为 HTTPRoundTrip 注册到 Mux, 例如 mux.SetDefaultHTTPRoundTrip(NewGRPCMux(NormalRoundTrip).RoundTrip)
+type GRPCMux struct {
+	Next  HTTPRoundTrip
+	mutex sync.RWMutex
+	hooks map[string]*GRPCHooks
+	files *protoregistry.Files
+}
+
+func NewGRPCMux(next HTTPRoundTrip) *GRPCMux {
+	return &GRPCMux{Next: next, hooks: make(map[string]*GRPCHooks)}
+}
+
+// Register 注册钩子, name 为完整方法名 /package.Service/Method 或服务名 package.Service, 方法优先; 服务过程中也可以注册
+func (g *GRPCMux) Register(name string, hooks *GRPCHooks) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.hooks[strings.TrimPrefix(name, "/")] = hooks
+}
+
+func (g *GRPCMux) lookup(call *GRPCCall) *GRPCHooks {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	if hooks, ok := g.hooks[call.Service+"/"+call.Method]; ok {
+		return hooks
+	}
+	if hooks, ok := g.hooks[call.Service]; ok {
+		return hooks
+	}
+	return &GRPCHooks{}
+}
+
+func (g *GRPCMux) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isGRPC(req.Header) {
+		return g.Next(req)
+	}
+	service, method, ok := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	if !ok {
+		return g.Next(req)
+	}
+	call := &GRPCCall{Service: service, Method: method, Request: req}
+	hooks := g.lookup(call)
+	if req.Body != nil && req.Body != http.NoBody && hooks.Request != nil {
+		req.Body = transformGRPC(call, req.Body, false, hooks.Request, nil)
+		req.ContentLength = -1
+		req.Header.Del("Content-Length")
+	}
+	resp, err := g.Next(req)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	call.Response = resp
+	if !isGRPC(resp.Header) || (hooks.Response == nil && hooks.Done == nil) {
+		return resp, nil
+	}
+	var done func()
+	if hooks.Done != nil {
+		done = func() { hooks.Done(call) }
+	}
+	// 修改 resp 本身而不是复制, Transport 在读完 Body 后才填入 resp.Trailer
+	resp.Body = transformGRPC(call, resp.Body, true, hooks.Response, done)
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	return resp, nil
+}
+
+func isGRPC(header http.Header) bool {
+	contentType := header.Get("Content-Type")
+	return strings.HasPrefix(contentType, "application/grpc") && !strings.HasPrefix(contentType, "application/grpc-web")
+}
+
+// transformGRPC 逐条读取 body 中的消息, 经过 hook 后重新编码, 读到 EOF 时调用 done
+func transformGRPC(call *GRPCCall, body io.ReadCloser, response bool, hook GRPCMessageFunc, done func()) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer body.Close()
+		for {
+			message, err := ReadGRPCMessage(body)
+			if errors.Is(err, io.EOF) {
+				if done != nil {
+					done()
+				}
+				pw.Close()
+				return
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			message.Response = response
+			messages := []*GRPCMessage{message}
+			if hook != nil {
+				messages, err = hook(call, message)
+				if err != nil {
+					pw.CloseWithError(xerrors.Errorf("%s: %w", call.FullMethod(), err))
+					return
+				}
+			}
+			for _, message := range messages {
+				_, err = pw.Write(BuildGRPCMessage(message))
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return &grpcBody{PipeReader: pr, body: body}
+}
+
+// grpcBody 关闭时同时关闭上游 body, 让阻塞在读取上游的 goroutine 退出
+type grpcBody struct {
+	*io.PipeReader
+	body io.ReadCloser
+}
+
+func (b *grpcBody) Close() error {
+	b.PipeReader.Close()
+	return b.body.Close()
+}
+
+// ReadGRPCMessage 读取一条消息, 消息之间没有数据时返回 io.EOF
+func ReadGRPCMessage(r io.Reader) (*GRPCMessage, error) {
+	var header [5]byte
+	_, err := io.ReadFull(r, header[:])
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > GRPCMaxMessageSize {
+		return nil, xerrors.Errorf("grpc message too large: %d", length)
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", io.ErrUnexpectedEOF)
+	}
+	return &GRPCMessage{Compressed: header[0]&1 == 1, Data: data}, nil
+}
+
+// BuildGRPCMessage 编码为 Compressed-Flag | Message-Length | Message
+func BuildGRPCMessage(message *GRPCMessage) []byte {
+	b := make([]byte, 5+len(message.Data))
+	if message.Compressed {
+		b[0] = 1
+	}
+	binary.BigEndian.PutUint32(b[1:5], uint32(len(message.Data)))
+	copy(b[5:], message.Data)
+	return b
+}
+
+// LoadDescriptorSet 加载 protoc --include_imports --descriptor_set_out 生成的 FileDescriptorSet, 之后可以用 DecodeJSON/EncodeJSON
+func (g *GRPCMux) LoadDescriptorSet(data []byte) error {
+	var set descriptorpb.FileDescriptorSet
+	err := proto.Unmarshal(data, &set)
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	g.mutex.Lock()
+	g.files = files
+	g.mutex.Unlock()
+	return nil
+}
+
+// DecodeJSON 按描述符把消息解码为 JSON, 请求和响应分别使用方法的输入和输出类型
+func (g *GRPCMux) DecodeJSON(call *GRPCCall, message *GRPCMessage) ([]byte, error) {
+	if message.Compressed {
+		return nil, xerrors.Errorf("%s: compressed message", call.FullMethod())
+	}
+	m, err := g.newMessage(call, message.Response)
+	if err != nil {
+		return nil, err
+	}
+	err = proto.Unmarshal(message.Data, m)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	data, err := protojson.Marshal(m)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	return data, nil
+}
+
+// EncodeJSON DecodeJSON 的逆操作, 用于修改或伪造消息
+func (g *GRPCMux) EncodeJSON(call *GRPCCall, data []byte, response bool) (*GRPCMessage, error) {
+	m, err := g.newMessage(call, response)
+	if err != nil {
+		return nil, err
+	}
+	err = protojson.Unmarshal(data, m)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	return &GRPCMessage{Data: b, Response: response}, nil
+}
+
+func (g *GRPCMux) newMessage(call *GRPCCall, response bool) (*dynamicpb.Message, error) {
+	g.mutex.RLock()
+	files := g.files
+	g.mutex.RUnlock()
+	if files == nil {
+		return nil, xerrors.New("no descriptor set loaded")
+	}
+	desc, err := files.FindDescriptorByName(protoreflect.FullName(call.Service + "." + call.Method))
+	if err != nil {
+		return nil, xerrors.Errorf("%s: %w", call.FullMethod(), err)
+	}
+	method, ok := desc.(protoreflect.MethodDescriptor)
+	if !ok {
+		return nil, xerrors.Errorf("%s: not a method", call.FullMethod())
+	}
+	if response {
+		return dynamicpb.NewMessage(method.Output()), nil
+	}
+	return dynamicpb.NewMessage(method.Input()), nil
+}
@@ -0,0 +1,190 @@
+package socksmitm_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/lomoalbert/socksmitm"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestGRPCMux(t *testing.T) {
+	var received [][]byte
+	echo := func(req *http.Request) (*http.Response, error) {
+		var body bytes.Buffer
+		if req.Body == nil {
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}
+		for {
+			message, err := socksmitm.ReadGRPCMessage(req.Body)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			received = append(received, message.Data)
+			body.Write(socksmitm.BuildGRPCMessage(message))
+		}
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": {"application/grpc"}},
+			Body:          io.NopCloser(&body),
+			ContentLength: int64(body.Len()),
+			Trailer:       http.Header{"Grpc-Status": {"5"}, "Grpc-Message": {"not%20found"}},
+		}, nil
+	}
+	grpcMux := socksmitm.NewGRPCMux(echo)
+	var status string
+	grpcMux.Register("/test.Echo/Say", &socksmitm.GRPCHooks{
+		Request: func(call *socksmitm.GRPCCall, message *socksmitm.GRPCMessage) ([]*socksmitm.GRPCMessage, error) {
+			upper := &socksmitm.GRPCMessage{Data: bytes.ToUpper(message.Data)}
+			return []*socksmitm.GRPCMessage{upper, message}, nil
+		},
+		Response: func(call *socksmitm.GRPCCall, message *socksmitm.GRPCMessage) ([]*socksmitm.GRPCMessage, error) {
+			if !message.Response || bytes.Equal(message.Data, []byte("ping")) {
+				return nil, nil
+			}
+			return []*socksmitm.GRPCMessage{message}, nil
+		},
+		Done: func(call *socksmitm.GRPCCall) {
+			code, message, ok := call.Status()
+			status = fmt.Sprintf("%s %d %s", call.FullMethod(), code, message)
+			if !ok {
+				status = "no status"
+			}
+		},
+	})
+
+	body := append(socksmitm.BuildGRPCMessage(&socksmitm.GRPCMessage{Data: []byte("ping")}), socksmitm.BuildGRPCMessage(&socksmitm.GRPCMessage{Data: []byte("pong")})...)
+	req, _ := http.NewRequest(http.MethodPost, "https://grpc.test/test.Echo/Say", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	resp, err := grpcMux.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var responses []string
+	for {
+		message, err := socksmitm.ReadGRPCMessage(resp.Body)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		responses = append(responses, string(message.Data))
+	}
+	resp.Body.Close()
+	if len(received) != 4 || string(received[0]) != "PING" || string(received[3]) != "pong" {
+		t.Errorf("server received %q", received)
+	}
+	if strings.Join(responses, ",") != "PING,PONG,pong" {
+		t.Errorf("client received %q", responses)
+	}
+	if status != "/test.Echo/Say 5 not found" {
+		t.Errorf("status %q", status)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, "https://grpc.test/", nil)
+	received = nil
+	if _, err = grpcMux.RoundTrip(req); err != nil || len(received) != 0 {
+		t.Errorf("plain request: %v %q", err, received)
+	}
+}
+
+func TestGRPCMux_JSON(t *testing.T) {
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("echo.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Ping"),
+			Field: []*descriptorpb.FieldDescriptorProto{{
+				Name:     proto.String("text"),
+				JsonName: proto.String("text"),
+				Number:   proto.Int32(1),
+				Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			}},
+		}},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name:   proto.String("Echo"),
+			Method: []*descriptorpb.MethodDescriptorProto{{Name: proto.String("Say"), InputType: proto.String(".test.Ping"), OutputType: proto.String(".test.Ping")}},
+		}},
+	}}}
+	data, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcMux := socksmitm.NewGRPCMux(nil)
+	if err = grpcMux.LoadDescriptorSet(data); err != nil {
+		t.Fatal(err)
+	}
+	call := &socksmitm.GRPCCall{Service: "test.Echo", Method: "Say"}
+	message, err := grpcMux.EncodeJSON(call, []byte(`{"text":"hello"}`), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(message.Data, []byte{0x0a, 0x05, 'h', 'e', 'l', 'l', 'o'}) {
+		t.Errorf("encoded %x", message.Data)
+	}
+	decoded, err := grpcMux.DecodeJSON(call, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.ReplaceAll(string(decoded), " ", "") != `{"text":"hello"}` {
+		t.Errorf("decoded %s", decoded)
+	}
+}
+
+func TestGRPCMux_RegisterWhileServing(t *testing.T) {
+	grpcMux := socksmitm.NewGRPCMux(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"application/grpc"}}, Body: http.NoBody}, nil
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			grpcMux.Register(fmt.Sprintf("test.Service%d", i), &socksmitm.GRPCHooks{})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		req, _ := http.NewRequest(http.MethodPost, "https://grpc.test/test.Service1/Call", http.NoBody)
+		req.Header.Set("Content-Type", "application/grpc")
+		resp, err := grpcMux.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	<-done
+}
+
+func TestGRPCMux_CloseBeforeEOF(t *testing.T) {
+	upstream, writer := io.Pipe()
+	defer writer.Close()
+	grpcMux := socksmitm.NewGRPCMux(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"application/grpc"}}, Body: upstream}, nil
+	})
+	grpcMux.Register("test.Stream", &socksmitm.GRPCHooks{
+		Response: func(call *socksmitm.GRPCCall, message *socksmitm.GRPCMessage) ([]*socksmitm.GRPCMessage, error) {
+			return []*socksmitm.GRPCMessage{message}, nil
+		},
+	})
+	req, _ := http.NewRequest(http.MethodPost, "https://grpc.test/test.Stream/Watch", http.NoBody)
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := grpcMux.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 上游流还没结束时客户端关闭 body, 上游 body 也要关闭
+	resp.Body.Close()
+	if _, err = writer.Write(socksmitm.BuildGRPCMessage(&socksmitm.GRPCMessage{Data: []byte("event")})); err != io.ErrClosedPipe {
+		t.Errorf("upstream body not closed: %v", err)
+	}
+}
@@ -1,44 +1,82 @@
 package socksmitm
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
-	"fmt"
 	"golang.org/x/net/proxy"
 	"golang.org/x/xerrors"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"strconv"
 )
 
 type Mux struct {
 	DefaultHTTPHandler HTTPRoundTrip
 	HTTPHandlerMap     HTTPHandlerMap
-	DefaultUDPHandler  UDPHandlerFunc
+	DefaultUDPHandler  UDPHandler
 	UDPHandlerMap      UDPHandlerMap
+	DefaultRawHandler  RawHandlerFunc
+	RawHandlerMap      RawHandlerMap
+	// DefaultWebSocketHandler 为 nil 且 WebSocketHandlerMap 没有匹配时, WebSocket 连接不解析, 原样转发
+	DefaultWebSocketHandler WebSocketHandler
+	WebSocketHandlerMap     WebSocketHandlerMap
+	Dialer                  proxy.Dialer
 }
 
 type HTTPHandlerMap map[string]HTTPRoundTrip
 type HTTPRoundTrip func(*http.Request) (*http.Response, error)
-type UDPHandlerMap map[string]UDPHandlerFunc
-type UDPHandlerFunc func(clientConn net.Conn, host string, port int)
+type UDPHandlerMap map[string]UDPHandler
+
+// RawHandlerMap 键为 "host:port" 或 "host"
+type RawHandlerMap map[string]RawHandlerFunc
+
+// RawHandlerFunc 处理既不是 TLS 也不是 HTTP 的数据流
+type RawHandlerFunc func(ctx context.Context, conn net.Conn, host string, port int)
+
+// UDPDatagram 经过 UDP 中继的一个数据报
+// Reply 为 false 时是客户端发往 Host:Port 的数据报, 为 true 时是 Host:Port 发回客户端的数据报
+type UDPDatagram struct {
+	Client  net.Addr
+	Host    string
+	Port    int
+	Payload []byte
+	Reply   bool
+}
+
+// UDPHandler 对每个数据报调用一次, 返回的数据报按 Reply 转发给 Host:Port 或发回客户端, 返回空则丢弃
+type UDPHandler interface {
+	HandleUDP(ctx context.Context, datagram *UDPDatagram) ([]*UDPDatagram, error)
+}
+
+type UDPHandlerFunc func(ctx context.Context, datagram *UDPDatagram) ([]*UDPDatagram, error)
+
+func (f UDPHandlerFunc) HandleUDP(ctx context.Context, datagram *UDPDatagram) ([]*UDPDatagram, error) {
+	return f(ctx, datagram)
+}
 
 func NewMux(DefaultDialer proxy.Dialer) *Mux {
-	return &Mux{
-		DefaultHTTPHandler: NormalRoundTrip,
-		HTTPHandlerMap:     make(HTTPHandlerMap),
-		DefaultUDPHandler:  NewDefaultUDPHandlerFunc(DefaultDialer),
-		UDPHandlerMap:      make(UDPHandlerMap),
+	mux := &Mux{
+		DefaultHTTPHandler:  NormalRoundTrip,
+		HTTPHandlerMap:      make(HTTPHandlerMap),
+		DefaultUDPHandler:   UDPHandlerFunc(ForwardUDPHandlerFunc),
+		UDPHandlerMap:       make(UDPHandlerMap),
+		RawHandlerMap:       make(RawHandlerMap),
+		WebSocketHandlerMap: make(WebSocketHandlerMap),
+		Dialer:              DefaultDialer,
 	}
+	mux.DefaultRawHandler = mux.SpliceRawHandlerFunc
+	return mux
 }
 
 func (mux *Mux) SetDefaultHTTPRoundTrip(handler HTTPRoundTrip) {
 	mux.DefaultHTTPHandler = handler
 }
 
-func (mux *Mux) SetDefaultUDPHandlerFunc(UDPhandler UDPHandlerFunc) {
+func (mux *Mux) SetDefaultUDPHandler(UDPhandler UDPHandler) {
 	mux.DefaultUDPHandler = UDPhandler
 }
 
@@ -46,72 +84,108 @@ func (mux *Mux) Register(host string, handler HTTPRoundTrip) {
 	mux.HTTPHandlerMap[host] = handler
 }
 
-func (mux *Mux) HandleHTTPS(conn net.Conn, clientHelloInfo *tls.ClientHelloInfo, targetIP string, port int) {
-	for {
-		req, err := http.ReadRequest(bufio.NewReader(conn))
-		if err != nil {
-			return
-		}
-		log.Println("req.Host:", req.Host, "req.URL.Host", req.URL.Host, "targetIP:", targetIP, "clientHelloInfo:", clientHelloInfo.ServerName)
+func (mux *Mux) RegisterUDP(host string, handler UDPHandler) {
+	mux.UDPHandlerMap[host] = handler
+}
 
-		handler := mux.DefaultHTTPHandler
-		handlerByHostName, ok := mux.HTTPHandlerMap[req.Host]
-		if ok && handlerByHostName != nil {
-			handler = handlerByHostName
-		}
-		req.URL.Scheme = "https"
-		req.RequestURI = ""
-		req.URL.Host = req.Host
-		resp, err := handler(req)
-		if err != nil {
-			log.Printf("%+v\n", err)
-			return
-		}
-		err = resp.Write(conn)
-		if err != nil {
-			log.Printf("%+v\n", err)
-			return
-		}
+func (mux *Mux) SetDefaultRawHandlerFunc(handler RawHandlerFunc) {
+	mux.DefaultRawHandler = handler
+}
+
+// RegisterRaw hostPort 为 "host:port" 时只处理该端口, 为 "host" 时处理该主机所有端口
+func (mux *Mux) RegisterRaw(hostPort string, handler RawHandlerFunc) {
+	mux.RawHandlerMap[hostPort] = handler
+}
+
+func (mux *Mux) SetDefaultWebSocketHandler(handler WebSocketHandler) {
+	mux.DefaultWebSocketHandler = handler
+}
+
+// RegisterWebSocket hostPath 为 "host/path" 时只处理该路径, 为 "host" 时处理该主机所有路径
+func (mux *Mux) RegisterWebSocket(hostPath string, handler WebSocketHandler) {
+	mux.WebSocketHandlerMap[hostPath] = handler
+}
+
+// DialContext 通过 Mux 的 Dialer 连接目标
+func (mux *Mux) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if dialer, ok := mux.Dialer.(proxy.ContextDialer); ok {
+		conn, err = dialer.DialContext(ctx, network, addr)
+	} else {
+		conn, err = mux.Dialer.Dial(network, addr)
 	}
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	return conn, nil
 }
-func (mux *Mux) HandleHTTP(conn net.Conn, targetIP string, port int) {
-	for {
-		req, err := http.ReadRequest(bufio.NewReader(conn))
-		if err != nil {
-			return
-		}
-		log.Println("req.Host:", req.Host, "req.URL.Host", req.URL.Host, "targetIP:", targetIP)
 
-		handler := mux.DefaultHTTPHandler
-		handlerByHostName, ok := mux.HTTPHandlerMap[req.Host]
-		if ok && handlerByHostName != nil {
-			handler = handlerByHostName
-		}
-		req.URL.Scheme = "http"
-		req.RequestURI = ""
-		req.URL.Host = req.Host
-		resp, err := handler(req)
-		if err != nil {
-			log.Printf("%+v\n", err)
-			return
-		}
-		defer resp.Body.Close()
-		err = resp.Write(conn)
-		if err != nil {
-			log.Printf("%+v\n", err)
-			return
-		}
+func (mux *Mux) HandleHTTPS(ctx context.Context, conn net.Conn, clientHelloInfo *tls.ClientHelloInfo, targetIP string, port int) {
+	defaultHost := clientHelloInfo.ServerName
+	if defaultHost == "" {
+		defaultHost = targetIP
+	}
+	if port != 443 {
+		defaultHost = net.JoinHostPort(defaultHost, strconv.Itoa(port))
+	}
+	mux.serveHTTP1(ctx, conn, "https", defaultHost, "targetIP:", targetIP, "clientHelloInfo:", clientHelloInfo.ServerName)
+}
+
+func (mux *Mux) HandleHTTP(ctx context.Context, conn net.Conn, targetIP string, port int) {
+	defaultHost := targetIP
+	if port != 80 {
+		defaultHost = net.JoinHostPort(defaultHost, strconv.Itoa(port))
+	}
+	mux.serveHTTP1(ctx, conn, "http", defaultHost, "targetIP:", targetIP)
+}
+
+// ServeRequest 按 req.Host 选择处理器, 把响应写回 w
+func (mux *Mux) ServeRequest(ctx context.Context, w io.Writer, req *http.Request, scheme string) error {
+	resp, err := mux.RoundTrip(ctx, req, scheme)
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	defer resp.Body.Close()
+	_, err = writeHTTP1Response(w, req, resp, req.Close)
+	if err != nil {
+		return xerrors.Errorf("%w", err)
 	}
+	return nil
+}
 
+func (mux *Mux) UDPHandle(ctx context.Context, datagram *UDPDatagram) ([]*UDPDatagram, error) {
+	udpHandler, ok := mux.UDPHandlerMap[datagram.Host]
+	if !ok || udpHandler == nil {
+		udpHandler = mux.DefaultUDPHandler
+	}
+	return udpHandler.HandleUDP(ctx, datagram)
 }
 
-func (mux *Mux) UDPHandle(conn net.Conn, host string, port int) {
-	udpHandler, ok := mux.UDPHandlerMap[host]
-	if !ok {
-		mux.DefaultUDPHandler(conn, host, port)
+func (mux *Mux) HandleRaw(ctx context.Context, conn net.Conn, host string, port int) {
+	log.Println("raw stream:", host, port)
+	rawHandler, ok := mux.RawHandlerMap[net.JoinHostPort(host, strconv.Itoa(port))]
+	if !ok || rawHandler == nil {
+		rawHandler, ok = mux.RawHandlerMap[host]
+	}
+	if !ok || rawHandler == nil {
+		rawHandler = mux.DefaultRawHandler
+	}
+	rawHandler(ctx, conn, host, port)
+}
+
+// SpliceRawHandlerFunc 通过 Dialer 连接真实目标并双向转发, BIND 时直接对接连入的对端
+func (mux *Mux) SpliceRawHandlerFunc(ctx context.Context, conn net.Conn, host string, port int) {
+	if upstream, ok := ctx.Value(upstreamContextKey).(*pinnedUpstream); ok {
+		splice(conn, upstream.conn)
+		return
+	}
+	upstream, err := mux.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		log.Printf("%+v\n", err)
 		return
 	}
-	udpHandler(conn, host, port)
+	splice(conn, upstream)
 }
 
 func BlockRoundTrip(req *http.Request) (*http.Response, error) {
@@ -119,16 +193,47 @@ func BlockRoundTrip(req *http.Request) (*http.Response, error) {
 	return nil, xerrors.New("blocked")
 }
 
-func BlockUDPHandlerFunc(conn net.Conn, host string, port int) {
+func BlockUDPHandlerFunc(ctx context.Context, datagram *UDPDatagram) ([]*UDPDatagram, error) {
+	//log.Println("block request to:", datagram.Host)
+	return nil, nil
+}
+
+func BlockRawHandlerFunc(ctx context.Context, conn net.Conn, host string, port int) {
 	//log.Println("block request to:", host)
-	return
+}
+
+// ForwardUDPHandlerFunc 原样转发
+func ForwardUDPHandlerFunc(ctx context.Context, datagram *UDPDatagram) ([]*UDPDatagram, error) {
+	return []*UDPDatagram{datagram}, nil
+}
+
+// RoundTrip 按 req.Host 选择处理器, 把客户端收到的请求改为发往 scheme://req.Host 的请求后交给处理器
+func (mux *Mux) RoundTrip(ctx context.Context, req *http.Request, scheme string) (*http.Response, error) {
+	handler := mux.DefaultHTTPHandler
+	handlerByHostName, ok := mux.HTTPHandlerMap[req.Host]
+	if ok && handlerByHostName != nil {
+		handler = handlerByHostName
+	}
+	req = req.WithContext(ctx)
+	req.URL.Scheme = scheme
+	req.RequestURI = ""
+	req.URL.Host = req.Host
+	resp, err := handler(req)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	return resp, nil
 }
 
 func NormalRoundTrip(req *http.Request) (*http.Response, error) {
+	if upstream, ok := req.Context().Value(upstreamContextKey).(*pinnedUpstream); ok && upstream.claim(req) {
+		return upstream.RoundTrip(req)
+	}
 	client := &http.Client{Transport: &http.Transport{
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: true,
 		},
+		ForceAttemptHTTP2: true,
 	}}
 	resp, err := client.Do(req)
 	if err != nil {
@@ -138,58 +243,23 @@ func NormalRoundTrip(req *http.Request) (*http.Response, error) {
 	return resp, nil
 }
 
+// CopyRoundTrip 请求 path 时在响应结束后把请求和响应 body 的副本交给 handler, body 边转发边复制
+// handler 无法得知副本是否被截断, 所以副本总是完整的 body, 不受 StreamMaxCapture 限制; 需要限制时使用 StreamRoundTrip
 func CopyRoundTrip(path string, handler func(req *http.Request, reqBody []byte, resp *http.Response, respBody []byte)) HTTPRoundTrip {
+	stream := StreamRoundTrip(NormalRoundTrip, &StreamHooks{
+		MaxCapture: math.MaxInt64,
+		Done: func(exchange *HTTPExchange) {
+			req := *exchange.Request
+			req.Body = io.NopCloser(bytes.NewReader(exchange.RequestBody))
+			resp := *exchange.Response
+			resp.Body = io.NopCloser(bytes.NewReader(exchange.ResponseBody))
+			go handler(&req, exchange.RequestBody, &resp, exchange.ResponseBody)
+		},
+	})
 	return func(req *http.Request) (*http.Response, error) {
 		if req.URL.Path != path {
 			return NormalRoundTrip(req)
 		}
-		reqBodyBytes, err := io.ReadAll(req.Body)
-		if err != nil {
-			return nil, xerrors.Errorf("%w", err)
-		}
-		req.ContentLength = int64(len(reqBodyBytes))
-		req.Body = io.NopCloser(bytes.NewReader(reqBodyBytes))
-		resp, err := NormalRoundTrip(req)
-		if err != nil {
-			return nil, xerrors.Errorf("%w\n", err)
-		}
-		respBodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, xerrors.Errorf("%w\n", err)
-		}
-		req.Body = io.NopCloser(bytes.NewReader(reqBodyBytes))
-		resp.Body = io.NopCloser(bytes.NewReader(respBodyBytes))
-		go handler(req, reqBodyBytes, resp, respBodyBytes)
-		return resp, nil
-	}
-}
-
-func NewDefaultUDPHandlerFunc(dialer proxy.Dialer) UDPHandlerFunc {
-	return func(clientConn net.Conn, host string, port int) {
-		//log.Println("req:", isTls, host, port)
-		serverConn, err := dialer.Dial("udp", fmt.Sprintf("%s:%d", host, port))
-		if err != nil {
-			log.Printf("%+v\n", err)
-			return
-		}
-		defer serverConn.Close()
-		defer clientConn.Close()
-		//websocket
-		go func() {
-			_, err := io.Copy(serverConn, clientConn)
-			if err != nil {
-				log.Printf("%#v\n", err)
-				return
-			}
-			//log.Println(n)
-		}()
-		go func() {
-			_, err := io.Copy(clientConn, serverConn)
-			if err != nil {
-				log.Printf("%#v\n", err)
-				return
-			}
-			//log.Println(n)
-		}()
+		return stream(req)
 	}
 }
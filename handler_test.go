@@ -0,0 +1,293 @@
+package socksmitm_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lomoalbert/socksmitm"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/proxy"
+)
+
+func TestMux_HandleRaw(t *testing.T) {
+	mux := socksmitm.NewMux(proxy.Direct)
+	var called []string
+	mux.RegisterRaw("example.com:22", func(ctx context.Context, conn net.Conn, host string, port int) {
+		called = append(called, "port")
+	})
+	mux.RegisterRaw("example.com", func(ctx context.Context, conn net.Conn, host string, port int) {
+		called = append(called, "host")
+	})
+	mux.SetDefaultRawHandlerFunc(func(ctx context.Context, conn net.Conn, host string, port int) {
+		called = append(called, "default")
+	})
+	client, conn := net.Pipe()
+	defer client.Close()
+	mux.HandleRaw(context.Background(), conn, "example.com", 22)
+	mux.HandleRaw(context.Background(), conn, "example.com", 5432)
+	mux.HandleRaw(context.Background(), conn, "example.org", 22)
+	if len(called) != 3 || called[0] != "port" || called[1] != "host" || called[2] != "default" {
+		t.Errorf("called: %v", called)
+	}
+}
+
+func TestMux_HandleHTTP2(t *testing.T) {
+	mux := socksmitm.NewMux(proxy.Direct)
+	mux.Register("h2.test", func(req *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(req.Body)
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": {"text/plain"}},
+			Body:          io.NopCloser(strings.NewReader(req.URL.String() + " " + string(body))),
+			ContentLength: -1,
+			Trailer:       http.Header{"Grpc-Status": {"0"}},
+		}, nil
+	})
+	transport := newH2Transport(mux)
+	defer transport.CloseIdleConnections()
+	resp, err := transport.RoundTrip(mustRequest(t, http.MethodPost, "http://h2.test/path", "ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "https://h2.test/path ping" {
+		t.Errorf("body %q", body)
+	}
+	if resp.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("trailer %v", resp.Trailer)
+	}
+}
+
+func TestMux_HandleHTTP_KeepAlive(t *testing.T) {
+	mux := socksmitm.NewMux(proxy.Direct)
+	mux.Register("keep.test", func(req *http.Request) (*http.Response, error) {
+		text := req.Method + " " + req.URL.Path
+		if req.URL.Path == "/echo" {
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			text += " " + string(body)
+		}
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Connection": {"keep-alive"}},
+			Body:          io.NopCloser(strings.NewReader(text)),
+			ContentLength: int64(len(text)),
+		}, nil
+	})
+	client, conn := net.Pipe()
+	defer client.Close()
+	go func() {
+		mux.HandleHTTP(context.Background(), conn, "keep.test", 80)
+		conn.Close()
+	}()
+	reader := bufio.NewReader(client)
+	expect := func(status int, want string) *http.Response {
+		t.Helper()
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != status || string(body) != want {
+			t.Fatalf("got %d %q, want %d %q", resp.StatusCode, body, status, want)
+		}
+		return resp
+	}
+	send := func(s string) {
+		t.Helper()
+		go io.WriteString(client, s)
+	}
+
+	// 两个请求一次写入, 第二个请求已经在 reader 的缓冲中
+	send("GET /1 HTTP/1.1\r\nHost: keep.test\r\n\r\nPOST /2 HTTP/1.1\r\nHost: keep.test\r\nContent-Length: 5\r\n\r\nhello")
+	expect(http.StatusOK, "GET /1")
+	expect(http.StatusOK, "POST /2")
+
+	send("POST /echo HTTP/1.1\r\nHost: keep.test\r\nContent-Length: 4\r\nExpect: 100-continue\r\n\r\n")
+	expect(http.StatusContinue, "")
+	send("ping")
+	expect(http.StatusOK, "POST /echo ping")
+
+	send("GET /3 HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	resp := expect(http.StatusOK, "GET /3")
+	if resp.Header.Get("Connection") != "keep-alive" || resp.ContentLength != 6 {
+		t.Errorf("http/1.0 keep-alive: %v", resp.Header)
+	}
+
+	send("GET /4 HTTP/1.1\r\nHost: keep.test\r\nConnection: close\r\n\r\n")
+	resp = expect(http.StatusOK, "GET /4")
+	if !resp.Close {
+		t.Errorf("connection close: %v", resp.Header)
+	}
+	_, err := reader.ReadByte()
+	if err != io.EOF {
+		t.Errorf("connection not closed: %v", err)
+	}
+}
+
+func TestMux_HandleHTTP_HeadUnknownLength(t *testing.T) {
+	mux := socksmitm.NewMux(proxy.Direct)
+	mux.Register("head.test", func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody, ContentLength: -1}, nil
+	})
+	client, conn := net.Pipe()
+	defer client.Close()
+	go func() {
+		mux.HandleHTTP(context.Background(), conn, "head.test", 80)
+		conn.Close()
+	}()
+	reader := bufio.NewReader(client)
+	go io.WriteString(client, "HEAD / HTTP/1.1\r\nHost: head.test\r\n\r\nGET / HTTP/1.1\r\nHost: head.test\r\n\r\n")
+	var head []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "\r\n" {
+			break
+		}
+		head = append(head, strings.TrimSpace(line))
+	}
+	for _, line := range head[1:] {
+		if strings.HasPrefix(line, "Content-Length") || strings.HasPrefix(line, "Connection") {
+			t.Errorf("head response: %q", head)
+		}
+	}
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("request after head: %v %v", resp, err)
+	}
+}
+
+func TestMux_HandleHTTP_RequestBodyConcurrency(t *testing.T) {
+	mux := socksmitm.NewMux(proxy.Direct)
+	responded := make(chan struct{})
+	mux.Register("body.test", func(req *http.Request) (*http.Response, error) {
+		text := "closed"
+		if req.URL.Path == "/close" {
+			// Read 阻塞等待客户端发送 body 时 Close 不应被阻塞
+			go io.ReadAll(req.Body)
+			time.Sleep(20 * time.Millisecond)
+			closed := make(chan struct{})
+			go func() {
+				req.Body.Close()
+				close(closed)
+			}()
+			select {
+			case <-closed:
+			case <-time.After(time.Second):
+				text = "blocked"
+			}
+		} else {
+			// 响应开始之后才读取 body, 不能再发送 100 Continue
+			go func() {
+				<-responded
+				io.ReadAll(req.Body)
+			}()
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(text)), ContentLength: int64(len(text))}, nil
+	})
+	client, conn := net.Pipe()
+	defer client.Close()
+	go func() {
+		mux.HandleHTTP(context.Background(), conn, "body.test", 80)
+		conn.Close()
+	}()
+	reader := bufio.NewReader(client)
+
+	// body 在响应之后才发送
+	go io.WriteString(client, "POST /close HTTP/1.1\r\nHost: body.test\r\nContent-Length: 4\r\n\r\n")
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "closed" {
+		t.Errorf("close while reading: %q", body)
+	}
+
+	// 上一个请求的 body 之后紧接着下一个请求
+	go io.WriteString(client, "pingPOST /late HTTP/1.1\r\nHost: body.test\r\nContent-Length: 4\r\nExpect: 100-continue\r\n\r\n")
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(responded)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("late read: status %d before the final response", resp.StatusCode)
+	}
+	io.ReadAll(resp.Body)
+	// 没有发送 100 Continue, 客户端可能不会发送 body, 连接不能复用
+	if _, err = reader.ReadByte(); err != io.EOF {
+		t.Errorf("connection still open: %v", err)
+	}
+}
+
+func TestMux_HandleHTTP2_UndeclaredTrailer(t *testing.T) {
+	mux := socksmitm.NewMux(proxy.Direct)
+	mux.Register("h2.test", func(req *http.Request) (*http.Response, error) {
+		// 与 http.Transport 一样, 读完 Body 之后才填入没有预先声明的 Trailer
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"application/grpc"}}, ContentLength: -1}
+		resp.Body = &trailerBody{Reader: strings.NewReader("data"), resp: resp}
+		return resp, nil
+	})
+	transport := newH2Transport(mux)
+	defer transport.CloseIdleConnections()
+	resp, err := transport.RoundTrip(mustRequest(t, http.MethodPost, "http://h2.test/pkg.Service/Method", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "data" || resp.Trailer.Get("Grpc-Status") != "5" || resp.Trailer.Get("Grpc-Message") != "not found" {
+		t.Errorf("body %q trailer %v", body, resp.Trailer)
+	}
+}
+
+type trailerBody struct {
+	io.Reader
+	resp *http.Response
+}
+
+func (body *trailerBody) Read(p []byte) (int, error) {
+	n, err := body.Reader.Read(p)
+	if err == io.EOF {
+		body.resp.Trailer = http.Header{"Grpc-Status": {"5"}, "Grpc-Message": {"not found"}}
+	}
+	return n, err
+}
+
+func (body *trailerBody) Close() error {
+	return nil
+}
+
+// newH2Transport 返回通过 net.Pipe 连到 mux.HandleHTTP2 的 HTTP/2 客户端
+func newH2Transport(mux *socksmitm.Mux) *http2.Transport {
+	client, conn := net.Pipe()
+	go mux.HandleHTTP2(context.Background(), conn, &tls.ClientHelloInfo{ServerName: "h2.test"}, "192.0.2.1", 443)
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return client, nil
+		},
+	}
+}
+
+func mustRequest(t *testing.T, method, url, body string) *http.Request {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
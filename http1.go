@@ -0,0 +1,256 @@
+package socksmitm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// maxDiscardBody 响应之后最多读掉的未读请求 body, 超过时关闭连接而不是继续读
+const maxDiscardBody = 256 << 10
+
+// serveHTTP1 HTTP/1.x 连接循环: 整个连接共用一个 reader, 按 Connection: close 和 HTTP/1.0 的语义决定是否复用连接
+// defaultHost 用于没有 Host 头的 HTTP/1.0 请求
+func (mux *Mux) serveHTTP1(ctx context.Context, conn net.Conn, scheme, defaultHost string, logArgs ...interface{}) {
+	pc := asPeekConn(conn)
+	for {
+		req, err := http.ReadRequest(pc.reader)
+		if err != nil {
+			return
+		}
+		if req.Host == "" {
+			req.Host = defaultHost
+		}
+		log.Println(append([]interface{}{"req.Host:", req.Host, "req.URL.Host", req.URL.Host}, logArgs...)...)
+		if isWebSocketUpgrade(req) {
+			err = mux.ServeWebSocket(ctx, pc, pc.reader, req, scheme)
+			if err != nil {
+				log.Printf("%+v\n", err)
+			}
+			return
+		}
+		keepAlive, err := mux.serveHTTP1Request(ctx, pc, req, scheme)
+		if err != nil {
+			log.Printf("%+v\n", err)
+		}
+		if !keepAlive {
+			return
+		}
+	}
+}
+
+// serveHTTP1Request 处理一个请求并把响应写回 conn, 响应写完后立即关闭响应 body; 返回连接是否可以继续读取下一个请求
+func (mux *Mux) serveHTTP1Request(ctx context.Context, conn io.Writer, req *http.Request, scheme string) (bool, error) {
+	w := &http1Writer{w: conn}
+	var body *requestBody
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &requestBody{body: req.Body, conn: w}
+		req.Body = body
+	}
+	if expect := req.Header.Get("Expect"); expect != "" {
+		if !strings.EqualFold(expect, "100-continue") || !req.ProtoAtLeast(1, 1) {
+			writeHTTPStatus(w, req, http.StatusExpectationFailed, nil)
+			return false, xerrors.Errorf("unsupported expect: %q", expect)
+		}
+		// 由我们在处理器第一次读取 body 时回复 100 Continue, 上游不再需要处理
+		req.Header.Del("Expect")
+		if body != nil {
+			body.expectContinue = true
+		}
+	}
+	closeAfter := req.Close
+	resp, err := mux.RoundTrip(ctx, req, scheme)
+	if err != nil {
+		writeHTTPStatus(w, req, http.StatusBadGateway, nil)
+		return false, xerrors.Errorf("%w", err)
+	}
+	keepAlive, err := writeHTTP1Response(w, req, resp, closeAfter)
+	resp.Body.Close()
+	if err != nil {
+		return false, xerrors.Errorf("%w", err)
+	}
+	if body != nil && !body.discard() {
+		return false, nil
+	}
+	return keepAlive, nil
+}
+
+// writeHTTP1Response 按客户端的协议版本写回响应, 返回写完后连接是否可以复用
+// 上游可能是 HTTP/2, 写回客户端时使用 HTTP/1.1, 长度未知的响应分块发送, SSE 等流式响应边收边发
+func writeHTTP1Response(w io.Writer, req *http.Request, resp *http.Response, closeAfter bool) (bool, error) {
+	for _, key := range hopHeaders {
+		resp.Header.Del(key)
+	}
+	resp.ProtoMajor, resp.ProtoMinor = 1, 1
+	resp.TransferEncoding = nil
+	headOnly := false
+	if resp.ContentLength < 0 {
+		switch {
+		case !bodyAllowed(req, resp.StatusCode):
+			// 不写 Content-Length: HEAD 响应的 Content-Length 是 GET 的长度, 不能写 0
+			headOnly = true
+		case req.ProtoAtLeast(1, 1):
+			resp.TransferEncoding = []string{"chunked"}
+		default:
+			// HTTP/1.0 客户端不支持分块, 只能以关闭连接表示结束
+			closeAfter = true
+		}
+	}
+	resp.Close = closeAfter
+	if !closeAfter && !req.ProtoAtLeast(1, 1) {
+		resp.Header.Set("Connection", "keep-alive")
+	}
+	var err error
+	if headOnly {
+		err = writeHTTP1Head(w, resp)
+	} else {
+		err = resp.Write(w)
+	}
+	if err != nil {
+		return false, xerrors.Errorf("%w", err)
+	}
+	return !closeAfter, nil
+}
+
+// writeHTTP1Head 只写状态行和头部; 长度未知时 resp.Write 总是加上 Connection: close, 没有 body 的响应不需要关闭连接
+func writeHTTP1Head(w io.Writer, resp *http.Response) error {
+	header := resp.Header.Clone()
+	if resp.Close {
+		header.Set("Connection", "close")
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.1 %03d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	header.WriteSubset(&buf, map[string]bool{"Content-Length": true, "Transfer-Encoding": true, "Trailer": true})
+	buf.WriteString("\r\n")
+	_, err := w.Write(buf.Bytes())
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	return nil
+}
+
+// http1Writer 同一个请求的 100 Continue 和最终响应都通过它写入连接:
+// 读取 body 的 goroutine 与写响应的 goroutine 不同, 开始写最终响应后不再发送 100 Continue
+type http1Writer struct {
+	mutex     sync.Mutex
+	w         io.Writer
+	continued bool
+	responded bool
+}
+
+func (w *http1Writer) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.responded = true
+	return w.w.Write(p)
+}
+
+// writeContinue 返回 100 Continue 是否已经发出
+func (w *http1Writer) writeContinue() (bool, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.continued {
+		return true, nil
+	}
+	if w.responded {
+		return false, nil
+	}
+	_, err := io.WriteString(w.w, "HTTP/1.1 100 Continue\r\n\r\n")
+	if err != nil {
+		return false, xerrors.Errorf("%w", err)
+	}
+	w.continued = true
+	return true, nil
+}
+
+// bodyAllowed HEAD 请求和 1xx/204/304 响应没有 body
+func bodyAllowed(req *http.Request, status int) bool {
+	if req.Method == http.MethodHead {
+		return false
+	}
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// requestBody 客户端请求的 body: 需要时在第一次读取前回复 100 Continue;
+// Close 只标记关闭, 剩余数据由 discard 在响应之后读掉, 以便读取同一连接上的下一个请求
+// mutex 保护状态, readMutex 串行化对 body 的读取, 阻塞的 Read 不会阻塞 Close
+type requestBody struct {
+	mutex          sync.Mutex
+	readMutex      sync.Mutex
+	body           io.ReadCloser
+	conn           *http1Writer
+	expectContinue bool
+	sawEOF         bool
+	closed         bool
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	b.mutex.Lock()
+	closed, expectContinue := b.closed, b.expectContinue
+	b.mutex.Unlock()
+	if closed {
+		return 0, http.ErrBodyReadAfterClose
+	}
+	if expectContinue {
+		// 响应已经开始时不再发送 100 Continue, expectContinue 保持为 true, discard 不会等待客户端可能不发送的 body
+		sent, err := b.conn.writeContinue()
+		if err != nil {
+			return 0, xerrors.Errorf("%w", err)
+		}
+		if sent {
+			b.mutex.Lock()
+			b.expectContinue = false
+			b.mutex.Unlock()
+		}
+	}
+	b.readMutex.Lock()
+	defer b.readMutex.Unlock()
+	n, err := b.body.Read(p)
+	if errors.Is(err, io.EOF) {
+		b.mutex.Lock()
+		b.sawEOF = true
+		b.mutex.Unlock()
+	}
+	return n, err
+}
+
+func (b *requestBody) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	return nil
+}
+
+// discard 读掉未读的 body, 返回 false 表示连接不能复用: 没有回复 100 Continue 时客户端可能不会发送 body, body 太长时不值得读完
+func (b *requestBody) discard() bool {
+	b.mutex.Lock()
+	b.closed = true
+	sawEOF, expectContinue := b.sawEOF, b.expectContinue
+	b.mutex.Unlock()
+	if sawEOF {
+		return true
+	}
+	if expectContinue {
+		return false
+	}
+	// 等待进行中的 Read 结束
+	b.readMutex.Lock()
+	defer b.readMutex.Unlock()
+	b.mutex.Lock()
+	sawEOF = b.sawEOF
+	b.mutex.Unlock()
+	if sawEOF {
+		return true
+	}
+	_, err := io.CopyN(io.Discard, b.body, maxDiscardBody)
+	return errors.Is(err, io.EOF)
+}
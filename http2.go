@@ -0,0 +1,92 @@
+package socksmitm
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/xerrors"
+)
+
+// hopHeaders 逐跳头部, 不能出现在 HTTP/2 响应中
+var hopHeaders = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Transfer-Encoding", "Upgrade"}
+
+// HandleHTTP2 ALPN 协商为 h2 时使用, 每个 stream 与 HTTP/1.1 请求一样交给 HTTPHandlerMap/DefaultHTTPHandler
+func (mux *Mux) HandleHTTP2(ctx context.Context, conn net.Conn, clientHelloInfo *tls.ClientHelloInfo, targetIP string, port int) {
+	server := &http2.Server{}
+	server.ServeConn(conn, &http2.ServeConnOpts{
+		Context: ctx,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			log.Println("req.Host:", req.Host, "req.URL.Path", req.URL.Path, "targetIP:", targetIP, "clientHelloInfo:", clientHelloInfo.ServerName, "h2")
+			mux.serveHTTP2Request(w, req, "https")
+		}),
+	})
+}
+
+// serveH2C 明文 HTTP/2 (prior knowledge), 请求按 http 发往目标
+func (mux *Mux) serveH2C(ctx context.Context, conn net.Conn, targetIP string, port int) {
+	server := &http2.Server{}
+	server.ServeConn(conn, &http2.ServeConnOpts{
+		Context: ctx,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			log.Println("req.Host:", req.Host, "req.URL.Path", req.URL.Path, "targetIP:", targetIP, "h2c")
+			mux.serveHTTP2Request(w, req, "http")
+		}),
+	})
+}
+
+// serveHTTP2Request 请求的 ctx 继承连接的 ctx (用户等信息), 并在 stream 结束时取消
+func (mux *Mux) serveHTTP2Request(w http.ResponseWriter, req *http.Request, scheme string) {
+	resp, err := mux.RoundTrip(req.Context(), req, scheme)
+	if err != nil {
+		log.Printf("%+v\n", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	err = writeResponse(w, resp)
+	if err != nil {
+		log.Printf("%+v\n", err)
+	}
+}
+
+// writeResponse 把 resp 写到 ResponseWriter, 每次写入后 Flush 以支持流式响应, 并转发 Trailer
+func writeResponse(w http.ResponseWriter, resp *http.Response) error {
+	header := w.Header()
+	for key, values := range resp.Header {
+		header[key] = values
+	}
+	for _, key := range hopHeaders {
+		header.Del(key)
+	}
+	if resp.ContentLength >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, err := io.Copy(flushWriter{w}, resp.Body)
+	// Trailer 在读完 Body 后才完整 (gRPC 不预先声明), 用 TrailerPrefix 发送
+	for key, values := range resp.Trailer {
+		header[http.TrailerPrefix+key] = values
+	}
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	return nil
+}
+
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	if flusher, ok := fw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,141 @@
+package socksmitm
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// RunHTTP 只接受 HTTP 代理请求 (CONNECT 和绝对 URI), Run 在同一端口上同时支持 SOCKS 和 HTTP 代理
+func (server *Server) RunHTTP(ctx context.Context, addr string) error {
+	log.Println("http proxy listen:", addr)
+	return server.serve(ctx, addr, server.HTTPProxyHandle)
+}
+
+// HTTPProxyHandle CONNECT 请求与 SOCKS CONNECT 一样嗅探 TLS/HTTP, 绝对 URI 请求直接交给 Mux
+func (server *Server) HTTPProxyHandle(conn net.Conn) error {
+	defer conn.Close()
+	pc := asPeekConn(conn)
+	for {
+		req, err := http.ReadRequest(pc.reader)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return xerrors.Errorf("%w", err)
+		}
+		ctx := context.Background()
+		if server.Authenticator != nil {
+			user, ok := server.httpProxyAuth(req)
+			if !ok {
+				writeHTTPStatus(pc, req, http.StatusProxyAuthRequired, http.Header{"Proxy-Authenticate": {`Basic realm="socksmitm"`}})
+				return xerrors.Errorf("http proxy auth failed: %s", req.Host)
+			}
+			ctx = withUser(ctx, user)
+		}
+		req.Header.Del("Proxy-Authorization")
+		req.Header.Del("Proxy-Connection")
+
+		defaultPort := "80"
+		if req.Method == http.MethodConnect {
+			defaultPort = "443"
+		}
+		host, portStr, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host, portStr = strings.Trim(req.Host, "[]"), defaultPort
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || host == "" {
+			writeHTTPStatus(pc, req, http.StatusBadRequest, nil)
+			return xerrors.Errorf("http proxy host: %q", req.Host)
+		}
+
+		if req.Method == http.MethodConnect {
+			ctx, rep := server.checkTarget(ctx, 0x01, host, port)
+			defer closeUpstreamConn(ctx)
+			if rep != RepSucceeded {
+				writeHTTPStatus(pc, req, httpStatus(rep), nil)
+				return xerrors.Errorf("connect %s:%d rejected: %x", host, port, rep)
+			}
+			_, err = io.WriteString(pc, "HTTP/1.1 200 Connection established\r\n\r\n")
+			if err != nil {
+				return xerrors.Errorf("%w", err)
+			}
+			server.serveStream(ctx, pc, host, port)
+			return nil
+		}
+
+		if req.URL.Host == "" {
+			writeHTTPStatus(pc, req, http.StatusBadRequest, nil)
+			return xerrors.Errorf("http proxy request without absolute uri: %s", req.URL)
+		}
+		if server.Ruleset != nil && !server.Ruleset(ctx, 0x01, host, port) {
+			writeHTTPStatus(pc, req, http.StatusForbidden, nil)
+			return xerrors.Errorf("http proxy %s:%d rejected", host, port)
+		}
+		log.Println("req.Host:", req.Host, "req.URL.Host", req.URL.Host, "proxy")
+		if isWebSocketUpgrade(req) {
+			return server.mux.ServeWebSocket(ctx, pc, pc.reader, req, req.URL.Scheme)
+		}
+		keepAlive, err := server.mux.serveHTTP1Request(ctx, pc, req, req.URL.Scheme)
+		if err != nil {
+			return xerrors.Errorf("%w", err)
+		}
+		if !keepAlive {
+			return nil
+		}
+	}
+}
+
+// httpProxyAuth 校验 Proxy-Authorization: Basic
+func (server *Server) httpProxyAuth(req *http.Request) (string, bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	scheme, credentials, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return "", false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok || !server.Authenticator.Authenticate(username, password) {
+		return "", false
+	}
+	return username, true
+}
+
+// httpStatus 把 REP 转换为 HTTP 代理的响应码
+func httpStatus(rep byte) int {
+	switch rep {
+	case RepNotAllowed:
+		return http.StatusForbidden
+	case RepTTLExpired:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func writeHTTPStatus(w io.Writer, req *http.Request, code int, header http.Header) {
+	if header == nil {
+		header = make(http.Header)
+	}
+	resp := &http.Response{
+		StatusCode: code,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Request:    req,
+		Close:      true,
+	}
+	resp.Write(w)
+}
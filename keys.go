@@ -0,0 +1,98 @@
+package socksmitm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"sync/atomic"
+
+	"golang.org/x/xerrors"
+)
+
+// KeyAlgorithm 伪造证书的私钥算法, 零值为 RSA-2048
+type KeyAlgorithm int
+
+const (
+	KeyRSA2048 KeyAlgorithm = iota
+	KeyRSA3072
+	KeyRSA4096
+	KeyECDSAP256
+	KeyECDSAP384
+	// KeyEd25519 部分浏览器不支持 Ed25519 证书
+	KeyEd25519
+)
+
+func (alg KeyAlgorithm) String() string {
+	switch alg {
+	case KeyRSA2048:
+		return "RSA-2048"
+	case KeyRSA3072:
+		return "RSA-3072"
+	case KeyRSA4096:
+		return "RSA-4096"
+	case KeyECDSAP256:
+		return "ECDSA-P256"
+	case KeyECDSAP384:
+		return "ECDSA-P384"
+	case KeyEd25519:
+		return "Ed25519"
+	default:
+		return "unknown"
+	}
+}
+
+// GenerateKey 生成 alg 算法的私钥
+func GenerateKey(alg KeyAlgorithm) (crypto.Signer, error) {
+	var key crypto.Signer
+	var err error
+	switch alg {
+	case KeyRSA2048:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case KeyRSA3072:
+		key, err = rsa.GenerateKey(rand.Reader, 3072)
+	case KeyRSA4096:
+		key, err = rsa.GenerateKey(rand.Reader, 4096)
+	case KeyECDSAP256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyECDSAP384:
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyEd25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, xerrors.Errorf("unknown key algorithm: %d", alg)
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	return key, nil
+}
+
+// KeyPool 预先生成的私钥, 多个主机的证书轮流使用, 省去每个新主机生成私钥的时间
+type KeyPool struct {
+	keys []crypto.Signer
+	next uint64
+}
+
+// NewKeyPool 生成 size 个 alg 算法的私钥, size 为 1 时所有主机共用一个私钥
+func NewKeyPool(alg KeyAlgorithm, size int) (*KeyPool, error) {
+	if size <= 0 {
+		return nil, xerrors.Errorf("key pool size: %d", size)
+	}
+	pool := &KeyPool{keys: make([]crypto.Signer, size)}
+	for i := range pool.keys {
+		key, err := GenerateKey(alg)
+		if err != nil {
+			return nil, xerrors.Errorf("%w", err)
+		}
+		pool.keys[i] = key
+	}
+	return pool, nil
+}
+
+// Key 轮流返回池中的私钥
+func (pool *KeyPool) Key() crypto.Signer {
+	return pool.keys[(atomic.AddUint64(&pool.next, 1)-1)%uint64(len(pool.keys))]
+}
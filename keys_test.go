@@ -0,0 +1,48 @@
+package socksmitm_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+
+	"github.com/lomoalbert/socksmitm"
+)
+
+func TestGenMITMTLSConfigWithKey(t *testing.T) {
+	ca, caKey := newTestCA(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	for _, alg := range []socksmitm.KeyAlgorithm{socksmitm.KeyRSA2048, socksmitm.KeyECDSAP256, socksmitm.KeyECDSAP384, socksmitm.KeyEd25519} {
+		key, err := socksmitm.GenerateKey(alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := socksmitm.GenMITMTLSConfigWithKey(ca, caKey, "example.test", key)
+		if err != nil {
+			t.Fatalf("%s: %+v", alg, err)
+		}
+		client, server := net.Pipe()
+		go tls.Server(server, config).Handshake()
+		err = tls.Client(client, &tls.Config{RootCAs: pool, ServerName: "www.example.test"}).Handshake()
+		if err != nil {
+			t.Errorf("%s: %v", alg, err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestKeyPool(t *testing.T) {
+	pool, err := socksmitm.NewKeyPool(socksmitm.KeyECDSAP256, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second, third := pool.Key(), pool.Key(), pool.Key()
+	if first == second || first != third {
+		t.Error("keys are not handed out round robin")
+	}
+	if _, err = socksmitm.NewKeyPool(socksmitm.KeyECDSAP256, 0); err == nil {
+		t.Error("empty pool accepted")
+	}
+}
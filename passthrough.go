@@ -0,0 +1,169 @@
+package socksmitm
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// PassthroughList 不拦截的目标, 匹配时 TLS 连接不解密, 原样转发到真实目标
+// 主机规则: "example.com" 精确匹配, "*.example.com" 匹配所有子域名; CIDR 规则匹配 IP 目标
+type PassthroughList struct {
+	mutex sync.RWMutex
+	hosts map[string]struct{}
+	cidrs map[string]*net.IPNet
+	// Func 不为 nil 时, 规则都不匹配再调用, serverName 为 SNI, host/port 为客户端请求的目标
+	Func func(serverName, host string, port int) bool
+}
+
+func NewPassthroughList() *PassthroughList {
+	return &PassthroughList{hosts: make(map[string]struct{}), cidrs: make(map[string]*net.IPNet)}
+}
+
+func (list *PassthroughList) AddHost(pattern string) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	list.hosts[strings.ToLower(pattern)] = struct{}{}
+}
+
+func (list *PassthroughList) RemoveHost(pattern string) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	delete(list.hosts, strings.ToLower(pattern))
+}
+
+func (list *PassthroughList) AddCIDR(cidr string) error {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	list.cidrs[ipNet.String()] = ipNet
+	return nil
+}
+
+func (list *PassthroughList) RemoveCIDR(cidr string) error {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	delete(list.cidrs, ipNet.String())
+	return nil
+}
+
+// Hosts 返回当前的主机规则
+func (list *PassthroughList) Hosts() []string {
+	list.mutex.RLock()
+	defer list.mutex.RUnlock()
+	hosts := make([]string, 0, len(list.hosts))
+	for host := range list.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// CIDRs 返回当前的 CIDR 规则
+func (list *PassthroughList) CIDRs() []string {
+	list.mutex.RLock()
+	defer list.mutex.RUnlock()
+	cidrs := make([]string, 0, len(list.cidrs))
+	for cidr := range list.cidrs {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+	return cidrs
+}
+
+// Match serverName (SNI) 或 host 匹配主机规则, host 为 IP 时匹配 CIDR 规则, 都不匹配时调用 Func
+func (list *PassthroughList) Match(serverName, host string, port int) bool {
+	list.mutex.RLock()
+	matched := list.matchHost(serverName) || list.matchHost(host) || list.matchIP(host)
+	list.mutex.RUnlock()
+	if matched {
+		return true
+	}
+	return list.Func != nil && list.Func(serverName, host, port)
+}
+
+func (list *PassthroughList) matchHost(host string) bool {
+	host = normalizeHost(host)
+	if host == "" {
+		return false
+	}
+	if _, ok := list.hosts[host]; ok {
+		return true
+	}
+	for i := strings.IndexByte(host, '.'); i >= 0; i = strings.IndexByte(host, '.') {
+		host = host[i+1:]
+		if _, ok := list.hosts["*."+host]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (list *PassthroughList) matchIP(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range list.cidrs {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var errClientHelloPeeked = xerrors.New("client hello peeked")
+
+// peekClientHello 解析 ClientHello 但不消费数据, 之后仍可以完整地转发或拦截
+func peekClientHello(pc *peekConn, timeout time.Duration) (*tls.ClientHelloInfo, error) {
+	pc.SetReadDeadline(time.Now().Add(timeout))
+	defer pc.SetReadDeadline(time.Time{})
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(&peekOnlyConn{peekConn: pc}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errClientHelloPeeked
+		},
+	}).HandshakeContext(context.Background())
+	if hello == nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	return hello, nil
+}
+
+// peekOnlyConn 通过 Peek 读取, 不移动 peekConn 的读位置, 不能写
+type peekOnlyConn struct {
+	*peekConn
+	offset int
+}
+
+func (conn *peekOnlyConn) Read(b []byte) (int, error) {
+	_, err := conn.peekConn.Peek(conn.offset + 1)
+	if err != nil {
+		return 0, err
+	}
+	head, err := conn.peekConn.Peek(conn.reader.Buffered())
+	if err != nil {
+		return 0, err
+	}
+	n := copy(b, head[conn.offset:])
+	conn.offset += n
+	return n, nil
+}
+
+func (conn *peekOnlyConn) Write(b []byte) (int, error) {
+	return 0, xerrors.New("peek only")
+}
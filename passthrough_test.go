@@ -0,0 +1,51 @@
+package socksmitm_test
+
+import (
+	"testing"
+
+	"github.com/lomoalbert/socksmitm"
+)
+
+func TestPassthroughList_Match(t *testing.T) {
+	list := socksmitm.NewPassthroughList()
+	list.AddHost("pinned.example.com")
+	list.AddHost("*.bank.test")
+	if err := list.AddCIDR("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		serverName string
+		host       string
+		matched    bool
+	}{
+		{"pinned.example.com", "1.2.3.4", true},
+		{"PINNED.example.com.", "1.2.3.4", true},
+		{"other.example.com", "1.2.3.4", false},
+		{"", "pinned.example.com", true},
+		{"a.b.bank.test", "1.2.3.4", true},
+		{"bank.test", "1.2.3.4", false},
+		{"", "10.1.2.3", true},
+		{"", "11.1.2.3", false},
+	}
+	for _, c := range cases {
+		if matched := list.Match(c.serverName, c.host, 443); matched != c.matched {
+			t.Errorf("Match(%q, %q) = %v, want %v", c.serverName, c.host, matched, c.matched)
+		}
+	}
+
+	list.RemoveHost("*.bank.test")
+	if err := list.RemoveCIDR("10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	if list.Match("a.bank.test", "10.1.2.3", 443) {
+		t.Error("removed rules still match")
+	}
+	if hosts := list.Hosts(); len(hosts) != 1 || hosts[0] != "pinned.example.com" {
+		t.Errorf("Hosts() = %v", hosts)
+	}
+
+	list.Func = func(serverName, host string, port int) bool { return port == 8443 }
+	if !list.Match("", "1.2.3.4", 8443) || list.Match("", "1.2.3.4", 443) {
+		t.Error("Func not consulted")
+	}
+}
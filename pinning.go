@@ -0,0 +1,180 @@
+package socksmitm
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// PinningThreshold 默认连续握手失败多少次后认为客户端固定了证书
+var PinningThreshold = 3
+
+// LearnedHost 自动学习到的透传主机
+type LearnedHost struct {
+	Host      string    `json:"host"`
+	Failures  int       `json:"failures"`
+	LearnedAt time.Time `json:"learned_at"`
+}
+
+// PinningDetector 统计每个 SNI 的证书拒绝 (bad_certificate/unknown_ca/certificate_unknown),
+// 连续失败达到 Threshold 后把主机加入学习到的透传列表, 之后该主机的 TLS 连接原样转发
+type PinningDetector struct {
+	// Threshold 小于等于 0 时使用 PinningThreshold
+	Threshold int
+	// path 不为空时学习到的列表持久化到该 JSON 文件
+	path     string
+	mutex    sync.Mutex
+	failures map[string]int
+	learned  map[string]LearnedHost
+}
+
+// NewPinningDetector path 为空时只保存在内存中, 文件存在时加载已学习的列表
+func NewPinningDetector(path string) (*PinningDetector, error) {
+	d := &PinningDetector{path: path, failures: make(map[string]int), learned: make(map[string]LearnedHost)}
+	if path == "" {
+		return d, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	var hosts []LearnedHost
+	err = json.Unmarshal(data, &hosts)
+	if err != nil {
+		return nil, xerrors.Errorf("%s: %w", path, err)
+	}
+	for _, host := range hosts {
+		d.learned[normalizeHost(host.Host)] = host
+	}
+	return d, nil
+}
+
+// Failed 记录一次证书被拒绝, 返回 true 表示该主机刚被加入透传列表
+func (d *PinningDetector) Failed(serverName string) (bool, error) {
+	host := normalizeHost(serverName)
+	if host == "" {
+		return false, nil
+	}
+	threshold := d.Threshold
+	if threshold <= 0 {
+		threshold = PinningThreshold
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, ok := d.learned[host]; ok {
+		return false, nil
+	}
+	d.failures[host]++
+	if d.failures[host] < threshold {
+		return false, nil
+	}
+	d.learned[host] = LearnedHost{Host: host, Failures: d.failures[host], LearnedAt: time.Now()}
+	delete(d.failures, host)
+	return true, d.save()
+}
+
+// Succeeded 握手成功时清零失败计数, 只统计连续的失败
+func (d *PinningDetector) Succeeded(serverName string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.failures, normalizeHost(serverName))
+}
+
+func (d *PinningDetector) Match(serverName string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	_, ok := d.learned[normalizeHost(serverName)]
+	return ok
+}
+
+// Learned 返回学习到的主机, 按主机名排序
+func (d *PinningDetector) Learned() []LearnedHost {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.sorted()
+}
+
+// Forget 从学习到的列表中删除主机, 之后重新拦截并计数
+func (d *PinningDetector) Forget(serverName string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.learned, normalizeHost(serverName))
+	return d.save()
+}
+
+func (d *PinningDetector) sorted() []LearnedHost {
+	hosts := make([]LearnedHost, 0, len(d.learned))
+	for _, host := range d.learned {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Host < hosts[j].Host })
+	return hosts
+}
+
+func (d *PinningDetector) save() error {
+	if d.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(d.sorted(), "", "  ")
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	return writeFileAtomic(d.path, data, 0o644)
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// certRejected 判断握手错误是否是客户端拒绝了伪造的证书: 收到 bad_certificate, certificate_unknown 或 unknown_ca 告警, 或者证书校验失败
+func certRejected(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	if errors.As(err, &verifyErr) {
+		return true
+	}
+	alertErr, ok := remoteAlert(err)
+	if !ok {
+		return false
+	}
+	switch alertErr {
+	case alertBadCertificate, alertCertificateUnknown, alertUnknownCA:
+		return true
+	}
+	return false
+}
+
+const (
+	alertBadCertificate     tls.AlertError = 42
+	alertCertificateUnknown tls.AlertError = 46
+	alertUnknownCA          tls.AlertError = 48
+)
+
+// remoteAlert 取出对端发来的 TLS 告警; TCP 连接上 crypto/tls 用未导出的 uint8 类型表示收到的告警, 按其数值转为 AlertError
+func remoteAlert(err error) (tls.AlertError, bool) {
+	var alertErr tls.AlertError
+	if errors.As(err, &alertErr) {
+		return alertErr, true
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" || opErr.Err == nil {
+		return 0, false
+	}
+	value := reflect.ValueOf(opErr.Err)
+	if value.Kind() != reflect.Uint8 {
+		return 0, false
+	}
+	return tls.AlertError(value.Uint()), true
+}
@@ -0,0 +1,104 @@
+package socksmitm_test
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lomoalbert/socksmitm"
+	"golang.org/x/net/proxy"
+)
+
+func TestPinningDetector(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "learned.json")
+	d, err := socksmitm.NewPinningDetector(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Threshold = 2
+
+	d.Failed("app.example.com")
+	d.Succeeded("app.example.com")
+	learned, err := d.Failed("app.example.com")
+	if err != nil || learned {
+		t.Fatalf("learned after reset: %v %v", learned, err)
+	}
+	learned, err = d.Failed("APP.example.com.")
+	if err != nil || !learned {
+		t.Fatalf("not learned after threshold: %v %v", learned, err)
+	}
+	if !d.Match("app.example.com") || d.Match("other.example.com") {
+		t.Error("Match")
+	}
+
+	reloaded, err := socksmitm.NewPinningDetector(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := reloaded.Learned()
+	if len(hosts) != 1 || hosts[0].Host != "app.example.com" || hosts[0].Failures != 2 {
+		t.Fatalf("Learned() = %+v", hosts)
+	}
+
+	err = reloaded.Forget("app.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err = socksmitm.NewPinningDetector(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Match("app.example.com") {
+		t.Error("forgotten host still learned")
+	}
+}
+
+func TestServer_PinningLearnsRejectedCertificate(t *testing.T) {
+	ca, key := newTestCA(t)
+	server, err := socksmitm.NewSocks5ServerWithCA(socksmitm.NewMux(proxy.Direct), ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Pinning, err = socksmitm.NewPinningDetector("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Pinning.Threshold = 2
+	dialer, err := proxy.SOCKS5("tcp", startTestServer(t, server), nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := func(config *tls.Config) error {
+		conn, err := dialer.Dial("tcp", "pin.test:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return tls.Client(conn, config).Handshake()
+	}
+	waitLearned := func(want bool) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for server.Pinning.Match("pin.test") != want && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if server.Pinning.Match("pin.test") != want {
+			t.Errorf("learned = %v, want %v", !want, want)
+		}
+	}
+
+	// 握手因其他原因失败 (版本不匹配) 不计数
+	for i := 0; i < 2; i++ {
+		handshake(&tls.Config{ServerName: "pin.test", MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS10})
+	}
+	waitLearned(false)
+
+	// 不信任伪造证书的客户端回复 bad_certificate / unknown_ca
+	for i := 0; i < 2; i++ {
+		if err = handshake(&tls.Config{ServerName: "pin.test"}); err == nil {
+			t.Fatal("handshake with untrusted ca succeeded")
+		}
+	}
+	waitLearned(true)
+}
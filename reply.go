@@ -0,0 +1,80 @@
+package socksmitm
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// RFC 1928 REP
+const (
+	RepSucceeded               byte = 0x00
+	RepGeneralFailure          byte = 0x01
+	RepNotAllowed              byte = 0x02
+	RepNetworkUnreachable      byte = 0x03
+	RepHostUnreachable         byte = 0x04
+	RepConnectionRefused       byte = 0x05
+	RepTTLExpired              byte = 0x06
+	RepCommandNotSupported     byte = 0x07
+	RepAddressTypeNotSupported byte = 0x08
+)
+
+// DialTimeout DialFirst 模式下连接目标的超时时间
+var DialTimeout = 10 * time.Second
+
+var errAddressType = xerrors.New("atyp unsupport")
+
+// RulesetFunc 在回复客户端前调用, 返回 false 时回复 RepNotAllowed
+// UDP ASSOCIATE 中数据报的每个新目标也以 cmd 0x03 检查, 拒绝的数据报被丢弃
+type RulesetFunc func(ctx context.Context, cmd byte, host string, port int) bool
+
+// ReplyCode 把连接目标时的错误转换为 REP
+func ReplyCode(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return RepSucceeded
+	case errors.Is(err, errAddressType):
+		return RepAddressTypeNotSupported
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return RepConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return RepNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return RepHostUnreachable
+	case errors.Is(err, syscall.ETIMEDOUT), errors.As(err, &netErr) && netErr.Timeout():
+		return RepTTLExpired
+	default:
+		return RepGeneralFailure
+	}
+}
+
+// socksFail 回复失败, BND 地址填 0
+func socksFail(conn net.Conn, rep byte) {
+	conn.Write([]byte{0x05, rep, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+}
+
+// checkTarget 按 Ruleset 和 DialFirst 检查目标, 返回应回复的 REP
+// DialFirst 连上的上游连接放在返回的 ctx 中, 由转发和发往该目标的第一个 NormalRoundTrip 请求直接使用, 调用方结束时用 closeUpstreamConn 关闭
+func (server *Server) checkTarget(ctx context.Context, cmd byte, host string, port int) (context.Context, byte) {
+	if server.Ruleset != nil && !server.Ruleset(ctx, cmd, host, port) {
+		return ctx, RepNotAllowed
+	}
+	if !server.DialFirst || cmd != 0x01 {
+		return ctx, RepSucceeded
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, DialTimeout)
+	defer cancel()
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	upstream, err := server.mux.DialContext(dialCtx, "tcp", target)
+	if err != nil {
+		return ctx, ReplyCode(err)
+	}
+	return withUpstreamConn(ctx, upstream, target), RepSucceeded
+}
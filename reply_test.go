@@ -0,0 +1,87 @@
+package socksmitm_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+
+	"github.com/lomoalbert/socksmitm"
+	"golang.org/x/xerrors"
+)
+
+func TestReplyCode(t *testing.T) {
+	cases := []struct {
+		err error
+		rep byte
+	}{
+		{nil, socksmitm.RepSucceeded},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, socksmitm.RepConnectionRefused},
+		{xerrors.Errorf("%w", &net.OpError{Op: "dial", Err: syscall.ENETUNREACH}), socksmitm.RepNetworkUnreachable},
+		{&net.DNSError{Err: "no such host", Name: "example.invalid"}, socksmitm.RepHostUnreachable},
+		{&net.OpError{Op: "dial", Err: syscall.ETIMEDOUT}, socksmitm.RepTTLExpired},
+		{xerrors.New("boom"), socksmitm.RepGeneralFailure},
+	}
+	for _, c := range cases {
+		if rep := socksmitm.ReplyCode(c.err); rep != c.rep {
+			t.Errorf("ReplyCode(%v) = %x, want %x", c.err, rep, c.rep)
+		}
+	}
+}
+
+func TestServer_Ruleset(t *testing.T) {
+	server := &socksmitm.Server{Ruleset: func(ctx context.Context, cmd byte, host string, port int) bool {
+		return host != "blocked.test"
+	}}
+	requests := map[string][]byte{
+		"ruleset":  append(append([]byte{0x05, 0x01, 0x00, 0x03, 0x0c}, "blocked.test"...), 0x00, 0x50),
+		"cmd":      {0x05, 0x09},
+		"atyp":     {0x05, 0x01, 0x00, 0x09},
+		"udp atyp": {0x05, 0x03, 0x00, 0x09},
+	}
+	expected := map[string]byte{
+		"ruleset":  socksmitm.RepNotAllowed,
+		"cmd":      socksmitm.RepCommandNotSupported,
+		"atyp":     socksmitm.RepAddressTypeNotSupported,
+		"udp atyp": socksmitm.RepAddressTypeNotSupported,
+	}
+	for name, request := range requests {
+		client, conn := net.Pipe()
+		go server.SocksHandle(conn)
+		client.Write([]byte{0x05, 0x01, 0x00})
+		reply := make([]byte, 2)
+		io.ReadFull(client, reply)
+		client.Write(request)
+		reply = make([]byte, 10)
+		io.ReadFull(client, reply)
+		if reply[1] != expected[name] {
+			t.Errorf("%s: reply %x", name, reply)
+		}
+		client.Close()
+	}
+}
+
+func TestServer_HTTPProxyRuleset(t *testing.T) {
+	server := &socksmitm.Server{Ruleset: func(ctx context.Context, cmd byte, host string, port int) bool {
+		return host != "blocked.test"
+	}}
+	client, conn := net.Pipe()
+	defer client.Close()
+	go server.ServeConn(conn)
+	go io.WriteString(client, "GET http://blocked.test/ HTTP/1.1\r\nHost: blocked.test\r\n\r\n")
+	reader := bufio.NewReader(client)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status: %d", resp.StatusCode)
+	}
+	// 拒绝后关闭连接, 不再读取后续请求
+	if _, err = reader.ReadByte(); err != io.EOF {
+		t.Errorf("connection still open: %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package socksmitm
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"golang.org/x/xerrors"
+)
+
+// Socks4Handle 处理 SOCKS4/SOCKS4a 请求, VN 和 CD 已由 SocksHandle 读取
+func (server *Server) Socks4Handle(conn net.Conn, cmd byte) error {
+	//+----+----+----+----+----+----+----+----+----+----+....+----+
+	//| VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+	//+----+----+----+----+----+----+----+----+----+----+....+----+
+	//| 1  | 1  |    2    |         4         | variable     | 1  |
+	//+----+----+----+----+----+----+----+----+----+----+....+----+
+	reqBytes := make([]byte, 6)
+	_, err := io.ReadFull(conn, reqBytes)
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	port := int(binary.BigEndian.Uint16(reqBytes[:2]))
+	ip := net.IP(reqBytes[2:6])
+	userID, err := readNullString(conn)
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	host := ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		// SOCKS4a: DSTIP 为 0.0.0.x 时 USERID 后跟域名
+		host, err = readNullString(conn)
+		if err != nil {
+			return xerrors.Errorf("%w", err)
+		}
+	}
+	if server.Authenticator != nil {
+		conn.Write(socks4Reply(0x5B, nil, 0))
+		return xerrors.New("socks4 rejected: authentication required")
+	}
+	ctx := context.Background()
+	if userID != "" {
+		ctx = context.WithValue(ctx, socks4UserIDContextKey, userID)
+	}
+
+	ctx, rep := server.checkTarget(ctx, cmd, host, port)
+	defer closeUpstreamConn(ctx)
+	if rep != RepSucceeded {
+		conn.Write(socks4Reply(0x5B, nil, 0))
+		return xerrors.Errorf("socks4 %s:%d rejected: %x", host, port, rep)
+	}
+
+	switch cmd {
+	case 0x01: //CONNECT
+		_, err = conn.Write(socks4Reply(0x5A, ip, port))
+		if err != nil {
+			return xerrors.Errorf("%w", err)
+		}
+		server.serveStream(ctx, conn, host, port)
+	case 0x02: //BIND
+		err = server.Socks4Bind(ctx, conn, host)
+		if err != nil {
+			return xerrors.Errorf("%w", err)
+		}
+	default:
+		conn.Write(socks4Reply(0x5B, nil, 0))
+		return xerrors.Errorf("cmd unsupport %x", cmd)
+	}
+	return nil
+}
+
+// Socks4Bind 与 SocksBind 相同, 只是回复格式不同
+func (server *Server) Socks4Bind(ctx context.Context, conn net.Conn, host string) error {
+	expected, err := lookupBindPeer(ctx, host)
+	if err != nil {
+		conn.Write(socks4Reply(0x5B, nil, 0))
+		return xerrors.Errorf("%w", err)
+	}
+	listener, err := bindListen(conn)
+	if err != nil {
+		conn.Write(socks4Reply(0x5B, nil, 0))
+		return xerrors.Errorf("%w", err)
+	}
+	defer listener.Close()
+	bndAddr := listener.Addr().(*net.TCPAddr)
+	_, err = conn.Write(socks4Reply(0x5A, bndAddr.IP, bndAddr.Port))
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+
+	peerConn, err := bindAccept(listener, expected)
+	if err != nil {
+		conn.Write(socks4Reply(0x5B, nil, 0))
+		return xerrors.Errorf("%w", err)
+	}
+	defer peerConn.Close()
+
+	peerAddr := peerConn.RemoteAddr().(*net.TCPAddr)
+	_, err = conn.Write(socks4Reply(0x5A, peerAddr.IP, peerAddr.Port))
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	server.serveStream(withUpstreamConn(ctx, peerConn, ""), conn, peerAddr.IP.String(), peerAddr.Port)
+	return nil
+}
+
+// socks4Reply VN | CD | DSTPORT | DSTIP, 非 IPv4 地址填 0
+func socks4Reply(cd byte, ip net.IP, port int) []byte {
+	b := binary.BigEndian.AppendUint16([]byte{0x00, cd}, uint16(port))
+	if ip4 := ip.To4(); ip4 != nil {
+		return append(b, ip4...)
+	}
+	return append(b, 0, 0, 0, 0)
+}
+
+// readNullString 读取以 NULL 结尾的字符串, 最长 255 字节
+func readNullString(conn net.Conn) (string, error) {
+	var b []byte
+	buff := make([]byte, 1)
+	for {
+		_, err := io.ReadFull(conn, buff)
+		if err != nil {
+			return "", xerrors.Errorf("%w", err)
+		}
+		if buff[0] == 0x00 {
+			return string(b), nil
+		}
+		if len(b) == 255 {
+			return "", xerrors.Errorf("string too long: %q", b)
+		}
+		b = append(b, buff[0])
+	}
+}
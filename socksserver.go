@@ -4,39 +4,229 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
-	"golang.org/x/crypto/pkcs12"
+	"errors"
+	"golang.org/x/net/publicsuffix"
 	"golang.org/x/xerrors"
 	"io"
+	"io/fs"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 type Server struct {
 	mux             *Mux
 	rootCertificate *x509.Certificate
 	rootPrivateKey  interface{}
-	configs         map[string]*tls.Config
+	chain           []*x509.Certificate
+	certs           *CertCache
 	Port            int
+	// Authenticator 不为 nil 时要求客户端使用用户名/密码认证 (METHOD 0x02), 同时拒绝没有密码的 SOCKS4 请求
+	Authenticator Authenticator
+	// DialFirst 为 true 时 CONNECT 先连接目标再回复, 客户端可以看到连接失败的原因
+	DialFirst bool
+	// Ruleset 不为 nil 时在回复前检查目标是否允许
+	Ruleset RulesetFunc
+	// Passthrough 不为 nil 时, 匹配的 TLS 连接不拦截, 原样转发
+	Passthrough *PassthroughList
+	// Pinning 不为 nil 时统计客户端拒绝伪造证书的次数, 自动透传固定了证书的主机
+	Pinning *PinningDetector
+	// CertStore 不为 nil 时优先使用磁盘上保存的证书, 新生成的证书也保存到磁盘
+	CertStore *CertStore
+	// KeyAlgorithm 伪造证书的私钥算法, 默认 RSA-2048
+	KeyAlgorithm KeyAlgorithm
+	// KeyPool 不为 nil 时从池中取私钥, 不再为每个主机生成, KeyAlgorithm 不再生效
+	KeyPool *KeyPool
+	// MimicUpstream 为 true 时连接真实主机, 复制其证书的 Subject, SAN 和有效期, 连接失败时使用默认模板
+	MimicUpstream bool
+	// DisableWildcard 为 true 时不再让兄弟子域名共用通配符证书, 每个主机单独签发
+	DisableWildcard bool
+	// NoWildcard 不为 nil 且返回 true 的主机单独签发, 其兄弟子域名仍共用通配符证书; 用于不接受通配符证书的客户端
+	NoWildcard func(host string) bool
+	// DisableHTTP2 为 true 时 ALPN 只提供 http/1.1, 客户端连接都降级为 HTTP/1.1
+	DisableHTTP2 bool
+	// SniffTimeout 等待客户端首包的时间, 超时视为由服务端先发数据的协议 (SSH, SMTP 等), 按原始数据流转发; 为 0 时使用 DefaultSniffTimeout
+	SniffTimeout time.Duration
 }
 
+// NewSocks5Server 从 PKCS#12 文件读取根证书和私钥, 支持旧的 SHA1/3DES 和新的 AES/SHA-256 (PBES2) 格式
+// 证书不是 CA 证书时返回的错误包含 ErrNotCA
 func NewSocks5Server(mux *Mux, pkcs12Data []byte, pkcs12Password string) (*Server, error) {
-	privateKey, ca, err := pkcs12.Decode(pkcs12Data, pkcs12Password)
+	privateKey, ca, chain, err := pkcs12.DecodeChain(pkcs12Data, pkcs12Password)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, xerrors.Errorf("unsupported private key: %T", privateKey)
+	}
+	return NewSocks5ServerWithCA(mux, ca, signer, chain...)
+}
+
+// NewSocks5ServerFromPEM 从 PEM 格式的根证书和私钥创建, 私钥支持 PKCS#1, PKCS#8 和 SEC1
+// certPEM 包含多个证书时, 第一个为签发证书, 其余为证书链; 签发证书不是 CA 证书时返回的错误包含 ErrNotCA
+func NewSocks5ServerFromPEM(mux *Mux, certPEM, keyPEM []byte) (*Server, error) {
+	certs, err := ParseCertificatesPEM(certPEM)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	privateKey, err := ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	return NewSocks5ServerWithCA(mux, certs[0], privateKey, certs[1:]...)
+}
+
+// ErrNotCA 签发证书没有 CA:TRUE 基本约束; 用它签发的伪造证书不会被客户端信任, 因此构造 Server 时直接拒绝, 不再等到握手时才失败
+var ErrNotCA = xerrors.New("not a ca certificate")
+
+// NewSocks5ServerWithCA 检查私钥与根证书匹配, 可以配合 GenerateRootCA 或 LoadOrCreateRootCA 使用
+// ca 为中间证书时 chain 为其上的证书 (可以不含根证书), 伪造的证书链为 leaf, ca, chain...
+// ca 不是 CA 证书时返回的错误包含 ErrNotCA
+func NewSocks5ServerWithCA(mux *Mux, ca *x509.Certificate, privateKey crypto.Signer, chain ...*x509.Certificate) (*Server, error) {
+	if !ca.IsCA {
+		return nil, xerrors.Errorf("%s: %w", ca.Subject, ErrNotCA)
+	}
+	publicKey, ok := privateKey.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(ca.PublicKey) {
+		return nil, xerrors.Errorf("private key does not match ca certificate: %s", ca.Subject)
+	}
+	chain, err := buildChain(ca, chain)
 	if err != nil {
 		return nil, xerrors.Errorf("%w", err)
 	}
-	return &Server{mux: mux, rootCertificate: ca, rootPrivateKey: privateKey, configs: make(map[string]*tls.Config)}, nil
+	server := &Server{mux: mux, rootCertificate: ca, rootPrivateKey: privateKey, chain: chain}
+	server.certs = NewCertCache(server.genConfig)
+	return server, nil
+}
+
+// buildChain 不依赖 certs 的顺序 (PKCS#12 中证书的顺序不固定), 用 x509.Verify 构建 ca 到最上层证书的链, 返回不含 ca 的部分
+// certs 中自签名的证书作为根; 没有根证书时, 不是由 certs 中其他证书签发的证书作为信任起点
+func buildChain(ca *x509.Certificate, certs []*x509.Certificate) ([]*x509.Certificate, error) {
+	if len(certs) == 0 {
+		return nil, nil
+	}
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	for _, cert := range certs {
+		if isChainTop(cert, certs) {
+			roots.AddCert(cert)
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	chains, err := ca.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("%s: chain: %w", ca.Subject, err)
+	}
+	return chains[0][1:], nil
+}
+
+// isChainTop 自签名, 或者不是由 certs 中其他证书签发
+func isChainTop(cert *x509.Certificate, certs []*x509.Certificate) bool {
+	if bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil {
+		return true
+	}
+	for _, parent := range certs {
+		if parent != cert && cert.CheckSignatureFrom(parent) == nil {
+			return false
+		}
+	}
+	return true
 }
 
+// CertCache 返回伪造证书的缓存, 可以调整大小或查看统计
+func (server *Server) CertCache() *CertCache {
+	return server.certs
+}
+
+func (server *Server) genConfig(name string) (*tls.Config, error) {
+	// MimicUpstream 时 name 是 host:port, 下面会拆开; 加载和保存都使用缓存的 name
+	storeName := name
+	if server.CertStore != nil {
+		config, err := server.CertStore.Load(storeName, server.rootCertificate)
+		if err == nil {
+			return config, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("%+v\n", err)
+		}
+	}
+	var key crypto.Signer
+	if server.KeyPool != nil {
+		key = server.KeyPool.Key()
+	} else {
+		var err error
+		key, err = GenerateKey(server.KeyAlgorithm)
+		if err != nil {
+			return nil, xerrors.Errorf("%w", err)
+		}
+	}
+	var config *tls.Config
+	var err error
+	temporary := false
+	if server.MimicUpstream {
+		// MimicUpstream 时缓存按 host:port 区分, 连接客户端实际请求的端口; 没有端口时使用 443
+		addr := net.JoinHostPort(name, "443")
+		if host, _, splitErr := net.SplitHostPort(name); splitErr == nil {
+			name, addr = host, name
+		}
+		var upstream *x509.Certificate
+		upstream, err = server.upstreamCertificate(name, addr)
+		if err == nil {
+			config, err = GenMimicTLSConfig(server.rootCertificate, server.rootPrivateKey, upstream, name, key, server.chain...)
+		}
+		if err != nil {
+			// 上游暂时连不上时使用默认证书, 不保存, 只缓存 TemporaryCertTTL 后再模仿上游
+			log.Printf("%+v\n", err)
+			temporary = true
+		}
+	}
+	if config == nil {
+		config, err = GenMITMTLSConfigWithKey(server.rootCertificate, server.rootPrivateKey, name, key, server.chain...)
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	if temporary {
+		return config, errTemporaryCert
+	}
+	if server.CertStore != nil {
+		err = server.CertStore.Save(storeName, config)
+		if err != nil {
+			log.Printf("%+v\n", err)
+		}
+	}
+	return config, nil
+}
+
+// Run 监听 addr, 根据首字节区分 SOCKS4/SOCKS5 和 HTTP 代理请求
 func (server *Server) Run(ctx context.Context, addr string) error {
+	log.Println("socks server listen:", addr)
+	return server.serve(ctx, addr, server.ServeConn)
+}
+
+func (server *Server) serve(ctx context.Context, addr string, handle func(conn net.Conn) error) error {
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return xerrors.Errorf("%w", err)
 	}
-	log.Println("socks server listen:", addr)
+	return server.serveListener(ctx, listener, handle)
+}
+
+func (server *Server) serveListener(ctx context.Context, listener net.Listener, handle func(conn net.Conn) error) error {
 	go func() {
 		<-ctx.Done()
 		listener.Close()
@@ -48,7 +238,7 @@ func (server *Server) Run(ctx context.Context, addr string) error {
 		}
 		//log.Println("got listener from:", conn.RemoteAddr())
 		go func() {
-			err = server.SocksHandle(conn)
+			err := handle(conn)
 			if err != nil {
 				log.Printf("%+v\n", err)
 			}
@@ -56,6 +246,22 @@ func (server *Server) Run(ctx context.Context, addr string) error {
 	}
 }
 
+// ServeConn 根据首字节把连接交给 SocksHandle 或 HTTPProxyHandle
+func (server *Server) ServeConn(conn net.Conn) error {
+	pc := asPeekConn(conn)
+	head, err := pc.Peek(1)
+	if err != nil {
+		conn.Close()
+		return xerrors.Errorf("%w", err)
+	}
+	switch head[0] {
+	case 0x04, 0x05:
+		return server.SocksHandle(pc)
+	default:
+		return server.HTTPProxyHandle(pc)
+	}
+}
+
 func (server *Server) SocksHandle(conn net.Conn) error {
 	defer conn.Close()
 	req1Byes := make([]byte, 2)
@@ -71,6 +277,17 @@ func (server *Server) SocksHandle(conn net.Conn) error {
 	if c != 2 {
 		return xerrors.Errorf("req header: %x", req1Byes)
 	}
+	switch req1Byes[0] {
+	case 0x04:
+		err = server.Socks4Handle(conn, req1Byes[1])
+		if err != nil {
+			return xerrors.Errorf("%w", err)
+		}
+		return nil
+	case 0x05:
+	default:
+		return xerrors.Errorf("version unsupport %x", req1Byes[0])
+	}
 	//log.Println("client conn read:", req1Byes)
 	reqMBytes := make([]byte, int(req1Byes[1]))
 	c, err = conn.Read(reqMBytes)
@@ -85,10 +302,29 @@ func (server *Server) SocksHandle(conn net.Conn) error {
 	//+----+--------+
 	//| 1  |   1    |
 	//+----+--------+
-	_, err = conn.Write([]byte{0x05, 0x00})
+	method := byte(0x00) // NO AUTHENTICATION REQUIRED
+	if server.Authenticator != nil {
+		method = 0x02 // USERNAME/PASSWORD
+	}
+	if !bytes.Contains(reqMBytes, []byte{method}) {
+		_, err = conn.Write([]byte{0x05, 0xFF}) // NO ACCEPTABLE METHODS
+		if err != nil {
+			return xerrors.Errorf("%w", err)
+		}
+		return xerrors.Errorf("no acceptable methods: %x", reqMBytes)
+	}
+	_, err = conn.Write([]byte{0x05, method})
 	if err != nil {
 		return xerrors.Errorf("%w", err)
 	}
+	ctx := context.Background()
+	if method == 0x02 {
+		user, err := server.SocksAuth(conn)
+		if err != nil {
+			return xerrors.Errorf("%w", err)
+		}
+		ctx = withUser(ctx, user)
+	}
 	//+----+-----+-------+------+----------+----------+
 	//|VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
 	//+----+-----+-------+------+----------+----------+
@@ -105,24 +341,76 @@ func (server *Server) SocksHandle(conn net.Conn) error {
 	cmd := reqMBytes[1]
 	switch cmd {
 	case 0x01: //CONNECT
-		err = server.SocksTCPConnect(conn)
+		err = server.SocksTCPConnect(ctx, conn)
 		if err != nil {
 			return xerrors.Errorf("%w", err)
 		}
 	case 0x02: //BIND
-		return xerrors.New("cmd unsupport") // todo:
+		err = server.SocksBind(ctx, conn)
+		if err != nil {
+			return xerrors.Errorf("%w", err)
+		}
 	case 0x03: //UDP ASSOCIATE
-		err = server.SocksUDPConnect(conn)
+		err = server.SocksUDPConnect(ctx, conn)
 		if err != nil {
 			return xerrors.Errorf("%w", err)
 		}
 	default:
+		socksFail(conn, RepCommandNotSupported)
 		return xerrors.Errorf("cmd unsupport %x", cmd)
 	}
 	return nil
 }
 
-func (server *Server) SocksTCPConnect(conn net.Conn) error {
+// SocksAuth 用户名/密码认证子协商 (RFC 1929), 返回认证通过的用户名
+func (server *Server) SocksAuth(conn net.Conn) (string, error) {
+	//+----+------+----------+------+----------+
+	//|VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+	//+----+------+----------+------+----------+
+	//| 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+	//+----+------+----------+------+----------+
+	reqBytes := make([]byte, 2)
+	_, err := io.ReadFull(conn, reqBytes)
+	if err != nil {
+		return "", xerrors.Errorf("%w", err)
+	}
+	if reqBytes[0] != 0x01 {
+		return "", xerrors.Errorf("auth version: %x", reqBytes[0])
+	}
+	username := make([]byte, int(reqBytes[1]))
+	_, err = io.ReadFull(conn, username)
+	if err != nil {
+		return "", xerrors.Errorf("%w", err)
+	}
+	_, err = io.ReadFull(conn, reqBytes[:1])
+	if err != nil {
+		return "", xerrors.Errorf("%w", err)
+	}
+	password := make([]byte, int(reqBytes[0]))
+	_, err = io.ReadFull(conn, password)
+	if err != nil {
+		return "", xerrors.Errorf("%w", err)
+	}
+	//+----+--------+
+	//|VER | STATUS |
+	//+----+--------+
+	//| 1  |   1    |
+	//+----+--------+
+	if !server.Authenticator.Authenticate(string(username), string(password)) {
+		_, err = conn.Write([]byte{0x01, 0x01})
+		if err != nil {
+			return "", xerrors.Errorf("%w", err)
+		}
+		return "", xerrors.Errorf("auth failed: %q", username)
+	}
+	_, err = conn.Write([]byte{0x01, 0x00})
+	if err != nil {
+		return "", xerrors.Errorf("%w", err)
+	}
+	return string(username), nil
+}
+
+func (server *Server) SocksTCPConnect(ctx context.Context, conn net.Conn) error {
 	reqMBytes := make([]byte, 2)
 	//+-------+------+----------+----------+
 	//|  RSV  | ATYP | DST.ADDR | DST.PORT |
@@ -149,7 +437,10 @@ func (server *Server) SocksTCPConnect(conn net.Conn) error {
 		}
 		dstAddr := reqMBytes[:4]
 		port := reqMBytes[4:]
-		server.SocksTCPConnectIPv4(conn, dstAddr, port)
+		err = server.SocksTCPConnectIPv4(ctx, conn, dstAddr, port)
+		if err != nil {
+			return xerrors.Errorf("%w", err)
+		}
 	case 0x03: // 域名
 		reqMBytes := make([]byte, 1)
 		c, err = conn.Read(reqMBytes)
@@ -170,127 +461,196 @@ func (server *Server) SocksTCPConnect(conn net.Conn) error {
 		}
 		domain := reqMBytes[:domainLength]
 		port := reqMBytes[domainLength:]
-		server.SocksTCPConnectDomain(conn, domain, port)
+		err = server.SocksTCPConnectDomain(ctx, conn, domain, port)
+		if err != nil {
+			return xerrors.Errorf("%w", err)
+		}
 	case 0x04: // IPv6
-		return xerrors.New("atyp unsupport") // todo:
+		reqMBytes := make([]byte, 18)
+		c, err = io.ReadFull(conn, reqMBytes)
+		if err != nil {
+			return xerrors.Errorf("%w", err)
+		}
+		if c != 18 {
+			return xerrors.Errorf("req header: %x", reqMBytes)
+		}
+		dstAddr := reqMBytes[:16]
+		port := reqMBytes[16:]
+		err = server.SocksTCPConnectIPv6(ctx, conn, dstAddr, port)
+		if err != nil {
+			return xerrors.Errorf("%w", err)
+		}
 	default:
-		return xerrors.New("atyp error")
+		socksFail(conn, RepAddressTypeNotSupported)
+		return xerrors.Errorf("%w: %x", errAddressType, atyp)
 	}
 	return nil
 }
 
-func (server *Server) SocksTCPConnectIPv4(conn net.Conn, ip []byte, port []byte) {
-	ipv4 := net.IPv4(ip[0], ip[1], ip[2], ip[3])
-	portInt := int(port[0])*256 + int(port[1])
-	domainStr := ipv4.String()
-	conn.Write(append(append([]byte{0x05, 0x00, 0x00, 0x01}, ip...), port...))
-	c1, c2 := net.Pipe()
-	defer c2.Close()
-	buff := make([]byte, 1)
-	c, err := conn.Read(buff)
+// readSocksAddr 读取 RSV | ATYP | DST.ADDR | DST.PORT
+func readSocksAddr(conn net.Conn) (string, int, error) {
+	reqBytes := make([]byte, 2)
+	_, err := io.ReadFull(conn, reqBytes)
 	if err != nil {
-		log.Printf("%+v\n", err)
-		return
+		return "", 0, xerrors.Errorf("%w", err)
 	}
-
-	isTls := buff[0] == byte(22)
-	go func() {
-		defer c1.Close()
-		_, err := c1.Write(buff[:c])
+	var host string
+	switch atyp := reqBytes[1]; atyp {
+	case 0x01: // IPv4
+		ip := make([]byte, net.IPv4len)
+		_, err = io.ReadFull(conn, ip)
 		if err != nil {
-			//log.Printf("%+v\n", err)
-			return
+			return "", 0, xerrors.Errorf("%w", err)
 		}
-		_, err = io.Copy(c1, conn)
+		host = net.IP(ip).String()
+	case 0x03: // 域名
+		_, err = io.ReadFull(conn, reqBytes[:1])
 		if err != nil {
-			//log.Printf("%+v\n", err)
-			return
+			return "", 0, xerrors.Errorf("%w", err)
 		}
-	}()
-	go func() {
-		_, err := io.Copy(conn, c1)
+		domain := make([]byte, int(reqBytes[0]))
+		_, err = io.ReadFull(conn, domain)
 		if err != nil {
-			//log.Printf("%+v\n", err)
-			return
+			return "", 0, xerrors.Errorf("%w", err)
 		}
-	}()
-	if isTls {
-		var clientHello = new(tls.ClientHelloInfo)
-		c2 = tls.Server(c2, &tls.Config{GetConfigForClient: server.GenFuncGetConfigForClient(clientHello)})
-		server.mux.HandleHTTPS(c2, clientHello, domainStr, portInt)
-	} else {
-		server.mux.HandleHTTP(c2, domainStr, portInt)
+		host = string(domain)
+	case 0x04: // IPv6
+		ip := make([]byte, net.IPv6len)
+		_, err = io.ReadFull(conn, ip)
+		if err != nil {
+			return "", 0, xerrors.Errorf("%w", err)
+		}
+		host = net.IP(ip).String()
+	default:
+		return "", 0, xerrors.Errorf("%w: %x", errAddressType, atyp)
+	}
+	_, err = io.ReadFull(conn, reqBytes)
+	if err != nil {
+		return "", 0, xerrors.Errorf("%w", err)
+	}
+	return host, int(reqBytes[0])*256 + int(reqBytes[1]), nil
+}
+
+func (server *Server) SocksTCPConnectIPv4(ctx context.Context, conn net.Conn, ip []byte, port []byte) error {
+	ipv4 := net.IPv4(ip[0], ip[1], ip[2], ip[3])
+	portInt := int(port[0])*256 + int(port[1])
+	domainStr := ipv4.String()
+	ctx, rep := server.checkTarget(ctx, 0x01, domainStr, portInt)
+	defer closeUpstreamConn(ctx)
+	_, err := conn.Write(append(append([]byte{0x05, rep, 0x00, 0x01}, ip...), port...))
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	if rep != RepSucceeded {
+		return xerrors.Errorf("connect %s:%d rejected: %x", domainStr, portInt, rep)
+	}
+	server.serveStream(ctx, conn, domainStr, portInt)
+	return nil
+}
+
+func (server *Server) SocksTCPConnectIPv6(ctx context.Context, conn net.Conn, ip []byte, port []byte) error {
+	ipv6 := net.IP(ip)
+	portInt := int(port[0])*256 + int(port[1])
+	domainStr := ipv6.String()
+	ctx, rep := server.checkTarget(ctx, 0x01, domainStr, portInt)
+	defer closeUpstreamConn(ctx)
+	_, err := conn.Write(append(append([]byte{0x05, rep, 0x00, 0x04}, ip...), port...))
+	if err != nil {
+		return xerrors.Errorf("%w", err)
 	}
+	if rep != RepSucceeded {
+		return xerrors.Errorf("connect %s:%d rejected: %x", domainStr, portInt, rep)
+	}
+	server.serveStream(ctx, conn, domainStr, portInt)
+	return nil
 }
 
-func (server *Server) SocksTCPConnectDomain(conn net.Conn, domain []byte, port []byte) {
+func (server *Server) SocksTCPConnectDomain(ctx context.Context, conn net.Conn, domain []byte, port []byte) error {
 	domainStr := string(domain)
 	portInt := int(port[0])*256 + int(port[1])
-	conn.Write(append(append([]byte{0x05, 0x00, 0x00, 0x03, byte(len(domain))}, domain...), port...))
-	c1, c2 := net.Pipe()
-	defer c2.Close()
-	buff := make([]byte, 1)
-	c, err := conn.Read(buff)
+	ctx, rep := server.checkTarget(ctx, 0x01, domainStr, portInt)
+	defer closeUpstreamConn(ctx)
+	_, err := conn.Write(append(append([]byte{0x05, rep, 0x00, 0x03, byte(len(domain))}, domain...), port...))
 	if err != nil {
-		log.Printf("%+v\n", err)
-		return
+		return xerrors.Errorf("%w", err)
+	}
+	if rep != RepSucceeded {
+		return xerrors.Errorf("connect %s:%d rejected: %x", domainStr, portInt, rep)
 	}
-	//log.Println("content type:", buff[:c])
+	server.serveStream(ctx, conn, domainStr, portInt)
+	return nil
+}
 
-	isTls := buff[0] == byte(22)
-	go func() {
-		defer c1.Close()
-		_, err := c1.Write(buff[:c])
-		if err != nil {
-			//log.Printf("%+v\n", err)
-			return
-		}
-		_, err = io.Copy(c1, conn)
-		if err != nil {
-			//log.Printf("%+v\n", err)
-			return
-		}
-	}()
-	go func() {
-		_, err := io.Copy(conn, c1)
-		if err != nil {
-			//log.Printf("%+v\n", err)
-			return
-		}
-	}()
-	if isTls {
-		var clientHello = new(tls.ClientHelloInfo)
-		c2 = tls.Server(c2, &tls.Config{GetConfigForClient: server.GenFuncGetConfigForClient(clientHello)})
-		server.mux.HandleHTTPS(c2, clientHello, domainStr, portInt)
-	} else {
-		server.mux.HandleHTTP(c2, domainStr, portInt)
+// upstreamCertificate 通过 Mux 的 Dialer 连接 addr, 以 name 作为 SNI, 返回上游的叶子证书
+func (server *Server) upstreamCertificate(name, addr string) (*x509.Certificate, error) {
+	if name == "" {
+		return nil, xerrors.New("mimic upstream: no server name")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	defer cancel()
+	conn, err := server.mux.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
 	}
+	defer conn.Close()
+	config := &tls.Config{InsecureSkipVerify: true}
+	if net.ParseIP(name) == nil {
+		config.ServerName = name
+	}
+	tlsConn := tls.Client(conn, config)
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		return nil, xerrors.Errorf("%s: %w", addr, err)
+	}
+	return tlsConn.ConnectionState().PeerCertificates[0], nil
 }
 
 func (server *Server) GenFuncGetConfigForClient(clientHelloInfo2 *tls.ClientHelloInfo) func(clientHelloInfo *tls.ClientHelloInfo) (*tls.Config, error) {
+	return server.GenFuncGetConfigForTarget(clientHelloInfo2, "")
+}
+
+// GenFuncGetConfigForTarget 与 GenFuncGetConfigForClient 相同, ClientHello 没有 SNI 时使用客户端请求的目标 host (域名或 IP) 签发证书
+// MimicUpstream 时连接目标的 443 端口, 需要其他端口时使用 GenFuncGetConfigForTargetPort
+func (server *Server) GenFuncGetConfigForTarget(clientHelloInfo2 *tls.ClientHelloInfo, host string) func(clientHelloInfo *tls.ClientHelloInfo) (*tls.Config, error) {
+	return server.GenFuncGetConfigForTargetPort(clientHelloInfo2, host, 443)
+}
+
+// GenFuncGetConfigForTargetPort 与 GenFuncGetConfigForTarget 相同, MimicUpstream 时连接目标的 port 端口复制证书
+func (server *Server) GenFuncGetConfigForTargetPort(clientHelloInfo2 *tls.ClientHelloInfo, host string, port int) func(clientHelloInfo *tls.ClientHelloInfo) (*tls.Config, error) {
 	return func(clientHelloInfo *tls.ClientHelloInfo) (*tls.Config, error) {
 		*clientHelloInfo2 = *clientHelloInfo
-		config, ok := server.configs[MainDomain(clientHelloInfo.ServerName)]
-		var err error
-		if !ok {
-			config, err = GenMITMTLSConfig(server.rootCertificate, server.rootPrivateKey, MainDomain(clientHelloInfo.ServerName))
-			if err != nil {
-				log.Printf("%+v\n", err)
-				return nil, err
-			}
-			server.configs[MainDomain(clientHelloInfo.ServerName)] = config
+		name := clientHelloInfo.ServerName
+		if name == "" {
+			name = host
+		}
+		name = server.certName(name)
+		if server.MimicUpstream {
+			name = net.JoinHostPort(name, strconv.Itoa(port))
+		}
+		config, err := server.certs.Get(name)
+		if err != nil {
+			log.Printf("%+v\n", err)
+			return nil, err
+		}
+		if server.DisableHTTP2 {
+			config = config.Clone()
+			config.NextProtos = []string{"http/1.1"}
 		}
 		return config, nil
 	}
 }
 
-// RegisterRootCa 注册 root.ca 处理器, 用于浏览器获取ca证书
+// RegisterRootCa 注册 root.ca 处理器, 用于浏览器获取ca证书; 使用中间证书时返回证书链最上层的证书
 func (server *Server) RegisterRootCa() {
 	log.Println("root ca url: http://root.ca/")
+	rootCertificate := server.rootCertificate
+	if len(server.chain) > 0 {
+		rootCertificate = server.chain[len(server.chain)-1]
+	}
 	server.mux.Register("root.ca", func(r *http.Request) (*http.Response, error) {
 		rootCertData := pem.EncodeToMemory(&pem.Block{
 			Type:  "CERTIFICATE",
-			Bytes: server.rootCertificate.Raw,
+			Bytes: rootCertificate.Raw,
 		})
 		defer r.Body.Close()
 		header := "HTTP/1.1 200 OK\nContent-Type: application/octet-stream\nContent-Disposition: attachment; filename=\"rootca.pem\"\nConnection: close\n\n"
@@ -303,83 +663,58 @@ func (server *Server) RegisterRootCa() {
 	})
 }
 
+// MainDomain 按公共后缀列表返回可注册的主域名, 如 a.b.example.co.uk 返回 example.co.uk; IP 或公共后缀本身原样返回
 func MainDomain(domain string) string {
-	return domain
+	domain = normalizeHost(domain)
+	if net.ParseIP(domain) != nil {
+		return domain
+	}
+	mainDomain, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return mainDomain
 }
 
-func (server *Server) SocksUDPConnect(conn net.Conn) error {
-	reqMBytes := make([]byte, 2)
+// certName 返回签发证书使用的名称, 证书同时包含 name 和 *.name
+// 兄弟子域名共用上一级域名的通配符证书, 但不会越过主域名; DisableWildcard 或 MimicUpstream 时每个主机单独签发, NoWildcard 匹配的主机单独签发
+func (server *Server) certName(serverName string) string {
+	serverName = normalizeHost(serverName)
+	if server.DisableWildcard || server.MimicUpstream || net.ParseIP(serverName) != nil {
+		return serverName
+	}
+	if server.NoWildcard != nil && server.NoWildcard(serverName) {
+		return serverName
+	}
+	mainDomain := MainDomain(serverName)
+	if serverName == mainDomain {
+		return serverName
+	}
+	_, parent, ok := strings.Cut(serverName, ".")
+	if !ok || !strings.HasSuffix("."+parent, "."+mainDomain) {
+		return serverName
+	}
+	return parent
+}
+
+func (server *Server) SocksUDPConnect(ctx context.Context, conn net.Conn) error {
 	//+-------+------+----------+----------+
 	//|  RSV  | ATYP | DST.ADDR | DST.PORT |
 	//+-------+------+----------+----------+
 	//| X'00' |  1   | Variable |    2     |
 	//+-------+------+----------+----------+
-	c, err := conn.Read(reqMBytes)
+	host, port, err := readSocksAddr(conn)
 	if err != nil {
+		socksFail(conn, ReplyCode(err))
 		return xerrors.Errorf("%w", err)
 	}
-	if c != 2 {
-		return xerrors.Errorf("req header: %x", reqMBytes)
+	if _, rep := server.checkTarget(ctx, 0x03, host, port); rep != RepSucceeded {
+		socksFail(conn, rep)
+		return xerrors.Errorf("udp associate %s:%d rejected: %x", host, port, rep)
 	}
-	atyp := reqMBytes[1]
-	switch atyp {
-	case 0x01: // IPv4
-		reqMBytes := make([]byte, 6)
-		c, err = conn.Read(reqMBytes)
-		if err != nil {
-			return xerrors.Errorf("%w", err)
-		}
-		if c != 6 {
-			return xerrors.Errorf("req header: %x", reqMBytes)
-		}
-		dstAddr := reqMBytes[:4]
-		port := reqMBytes[4:]
-		server.SocksUDPConnectIPv4(conn, dstAddr, port)
-	case 0x03: // 域名
-		reqMBytes := make([]byte, 1)
-		c, err = conn.Read(reqMBytes)
-		if err != nil {
-			return xerrors.Errorf("%w", err)
-		}
-		if c != 1 {
-			return xerrors.Errorf("req header: %x", reqMBytes)
-		}
-		domainLength := int(reqMBytes[0])
-		reqMBytes = make([]byte, domainLength+2)
-		c, err = conn.Read(reqMBytes)
-		if err != nil {
-			return xerrors.Errorf("%w", err)
-		}
-		if c != domainLength+2 {
-			return xerrors.Errorf("req header: %x", reqMBytes)
-		}
-		domain := reqMBytes[:domainLength]
-		port := reqMBytes[domainLength:]
-		server.SocksUDPConnectDomain(conn, domain, port)
-	case 0x04: // IPv6
-		return xerrors.New("atyp unsupport") // todo:
-	default:
-		return xerrors.New("atyp error")
+	err = server.SocksUDPAssociate(ctx, conn, host, port)
+	if err != nil {
+		return xerrors.Errorf("%w", err)
 	}
 	return nil
 }
-
-func (server *Server) SocksUDPConnectIPv4(conn net.Conn, ip []byte, port []byte) {
-	ipv4 := net.IPv4(ip[0], ip[1], ip[2], ip[3])
-	portInt := int(port[0])*256 + int(port[1])
-	//log.Println("ip:", ipv4)
-	//log.Println("port:", portInt)
-	domainStr := ipv4.String()
-	conn.Write(append(append([]byte{0x05, 0x00, 0x00, 0x01}, ip...), port...))
-
-	server.mux.UDPHandle(conn, domainStr, portInt)
-}
-
-func (server *Server) SocksUDPConnectDomain(conn net.Conn, domain []byte, port []byte) {
-	domainStr := string(domain)
-	portInt := int(port[0])*256 + int(port[1])
-	//log.Println("domainStr:", domainStr)
-	//log.Println("port:", portInt)
-	conn.Write(append(append([]byte{0x05, 0x00, 0x00, 0x03, byte(len(domain))}, domain...), port...))
-	server.mux.UDPHandle(conn, domainStr, portInt)
-}
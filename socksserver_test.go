@@ -1,12 +1,19 @@
 package socksmitm_test
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -74,3 +81,271 @@ func TestNewSocks5Server(t *testing.T) {
 	}
 	log.Println(string(data))
 }
+
+// startTestServer 在 127.0.0.1 的随机端口上运行 server, 返回监听地址
+func startTestServer(t *testing.T, server *socksmitm.Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeConn(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestServer_ConnectIPv6(t *testing.T) {
+	echo, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 loopback unavailable:", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	echoPort := echo.Addr().(*net.TCPAddr).Port
+	ca, key := newTestCA(t)
+	server, err := socksmitm.NewSocks5ServerWithCA(socksmitm.NewMux(proxy2.Direct), ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startTestServer(t, server)
+	ping := func(name string, w io.Writer, r io.Reader) {
+		t.Helper()
+		w.Write([]byte("\x00ping"))
+		buff := make([]byte, 5)
+		_, err := io.ReadFull(r, buff)
+		if err != nil || string(buff) != "\x00ping" {
+			t.Errorf("%s: echo %q %v", name, buff, err)
+		}
+	}
+
+	// SOCKS5 ATYP 0x04
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{0x05, 0x01, 0x00})
+	reply := make([]byte, 22)
+	io.ReadFull(conn, reply[:2])
+	request := append([]byte{0x05, 0x01, 0x00, 0x04}, net.IPv6loopback...)
+	conn.Write(append(request, byte(echoPort>>8), byte(echoPort)))
+	_, err = io.ReadFull(conn, reply)
+	if err != nil || reply[1] != socksmitm.RepSucceeded || reply[3] != 0x04 || !net.IP(reply[4:20]).Equal(net.IPv6loopback) {
+		t.Fatalf("socks5 reply %x %v", reply, err)
+	}
+	ping("socks5", conn, conn)
+
+	// HTTP CONNECT [::1]:port
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	target := net.JoinHostPort("::1", strconv.Itoa(echoPort))
+	io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("connect %s: %v %v", target, resp, err)
+	}
+	ping("http connect", conn, reader)
+}
+
+func TestServer_DialFirstReusesProbe(t *testing.T) {
+	var accepted int32
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				head, err := reader.Peek(1)
+				if err != nil {
+					return
+				}
+				if head[0] == 0x00 {
+					io.Copy(conn, reader)
+					return
+				}
+				// 每个连接只回复一个请求就关闭, 代理不能在探测连接上发送第二个请求
+				req, err := http.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				resp := &http.Response{StatusCode: http.StatusOK, ProtoMajor: 1, ProtoMinor: 1, Request: req,
+					Header: http.Header{}, ContentLength: 2, Body: io.NopCloser(strings.NewReader("ok"))}
+				resp.Write(conn)
+			}()
+		}
+	}()
+	port := upstream.Addr().(*net.TCPAddr).Port
+	ca, key := newTestCA(t)
+	server, err := socksmitm.NewSocks5ServerWithCA(socksmitm.NewMux(proxy2.Direct), ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.DialFirst = true
+	addr := startTestServer(t, server)
+	connect := func() net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte{0x05, 0x01, 0x00})
+		reply := make([]byte, 10)
+		io.ReadFull(conn, reply[:2])
+		conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, byte(port >> 8), byte(port)})
+		_, err = io.ReadFull(conn, reply)
+		if err != nil || reply[1] != socksmitm.RepSucceeded {
+			t.Fatalf("socks5 reply %x %v", reply, err)
+		}
+		return conn
+	}
+
+	conn := connect()
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+upstream.Addr().String()+"\r\n\r\n")
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "ok" {
+			t.Errorf("http body %q", body)
+		}
+	}
+	// 第一个请求使用探测连接, 第二个请求重新拨号
+	if n := atomic.LoadInt32(&accepted); n != 2 {
+		t.Errorf("http: upstream accepted %d connections", n)
+	}
+
+	atomic.StoreInt32(&accepted, 0)
+	conn = connect()
+	defer conn.Close()
+	conn.Write([]byte("\x00ping"))
+	buff := make([]byte, 5)
+	_, err = io.ReadFull(conn, buff)
+	if err != nil || string(buff) != "\x00ping" {
+		t.Errorf("raw echo %q %v", buff, err)
+	}
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Errorf("raw: upstream accepted %d connections", n)
+	}
+}
+
+func TestServer_DialFirstRewrittenHost(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "target")
+	}))
+	defer target.Close()
+	rewritten := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "rewritten")
+	}))
+	defer rewritten.Close()
+	mux := socksmitm.NewMux(proxy2.Direct)
+	mux.SetDefaultHTTPRoundTrip(func(req *http.Request) (*http.Response, error) {
+		req.URL.Host = rewritten.Listener.Addr().String()
+		return socksmitm.NormalRoundTrip(req)
+	})
+	ca, key := newTestCA(t)
+	server, err := socksmitm.NewSocks5ServerWithCA(mux, ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.DialFirst = true
+	conn, err := net.Dial("tcp", startTestServer(t, server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := target.Listener.Addr().(*net.TCPAddr).Port
+	conn.Write([]byte{0x05, 0x01, 0x00})
+	reply := make([]byte, 10)
+	io.ReadFull(conn, reply[:2])
+	conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, byte(port >> 8), byte(port)})
+	_, err = io.ReadFull(conn, reply)
+	if err != nil || reply[1] != socksmitm.RepSucceeded {
+		t.Fatalf("socks5 reply %x %v", reply, err)
+	}
+	// 处理器改了 URL.Host, 请求不能走探测时连上的 target
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+target.Listener.Addr().String()+"\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "rewritten" {
+		t.Errorf("http body %q", body)
+	}
+}
+
+func TestServer_H2C(t *testing.T) {
+	mux := socksmitm.NewMux(proxy2.Direct)
+	mux.Register("h2c.test", func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{},
+			Body:          io.NopCloser(strings.NewReader(req.URL.String())),
+			ContentLength: -1,
+		}, nil
+	})
+	ca, key := newTestCA(t)
+	server, err := socksmitm.NewSocks5ServerWithCA(mux, ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, err := proxy2.SOCKS5("tcp", startTestServer(t, server), nil, proxy2.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return dialer.Dial(network, addr)
+		},
+	}
+	defer transport.CloseIdleConnections()
+	req, err := http.NewRequest(http.MethodGet, "http://h2c.test/path", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 || string(body) != "http://h2c.test/path" {
+		t.Errorf("response %s %q", resp.Proto, body)
+	}
+}
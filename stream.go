@@ -0,0 +1,329 @@
+package socksmitm
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/xerrors"
+)
+
+// DefaultSniffTimeout Server.SniffTimeout 为 0 时等待客户端首包的时间
+const DefaultSniffTimeout = time.Second
+
+type protocol int
+
+const (
+	protocolRaw protocol = iota
+	protocolTLS
+	protocolHTTP
+	protocolH2C
+)
+
+// httpMethods "PRI " 是明文 HTTP/2 (prior knowledge) 连接前言 "PRI * HTTP/2.0" 的开头
+var httpMethods = []string{"GET ", "POST ", "PUT ", "HEAD ", "DELETE ", "OPTIONS ", "PATCH ", "TRACE ", "CONNECT ", "PRI "}
+
+// peekConn 可预读的连接, 用于嗅探协议后把完整数据流交给后续处理
+type peekConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// peekBufferSize 足够预读一个完整的 TLS 记录 (ClientHello)
+const peekBufferSize = 16*1024 + 5
+
+func newPeekConn(conn net.Conn) *peekConn {
+	return &peekConn{Conn: conn, reader: bufio.NewReaderSize(conn, peekBufferSize)}
+}
+
+// asPeekConn 已经是 peekConn 时直接返回, 避免重复缓冲
+func asPeekConn(conn net.Conn) *peekConn {
+	if pc, ok := conn.(*peekConn); ok {
+		return pc
+	}
+	return newPeekConn(conn)
+}
+
+func (conn *peekConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+func (conn *peekConn) Peek(n int) ([]byte, error) {
+	return conn.reader.Peek(n)
+}
+
+func (conn *peekConn) CloseWrite() error {
+	if cw, ok := conn.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return conn.Conn.Close()
+}
+
+// sniffTimeout 等待客户端首包的时间
+func (server *Server) sniffTimeout() time.Duration {
+	if server.SniffTimeout > 0 {
+		return server.SniffTimeout
+	}
+	return DefaultSniffTimeout
+}
+
+// serveStream 嗅探客户端数据流: TLS 交给 HandleHTTPS, HTTP 交给 HandleHTTP, 明文 HTTP/2 交给 serveH2C, 其余交给 HandleRaw
+func (server *Server) serveStream(ctx context.Context, conn net.Conn, host string, port int) {
+	pc := asPeekConn(conn)
+	proto, err := sniffProtocol(pc, server.sniffTimeout())
+	if err != nil {
+		log.Printf("%+v\n", err)
+		return
+	}
+	switch proto {
+	case protocolTLS:
+		server.serveTLS(ctx, pc, host, port)
+	case protocolHTTP:
+		server.mux.HandleHTTP(ctx, pc, host, port)
+	case protocolH2C:
+		server.mux.serveH2C(ctx, pc, host, port)
+	default:
+		server.mux.HandleRaw(ctx, pc, host, port)
+	}
+}
+
+// serveTLS Passthrough 或 Pinning 匹配 SNI 或目标时原样转发, 否则用伪造的证书解密后交给 HandleHTTPS
+func (server *Server) serveTLS(ctx context.Context, pc *peekConn, host string, port int) {
+	if server.Passthrough != nil || server.Pinning != nil {
+		hello, err := peekClientHello(pc, server.sniffTimeout())
+		if err != nil {
+			log.Printf("%+v\n", err)
+			return
+		}
+		if (server.Passthrough != nil && server.Passthrough.Match(hello.ServerName, host, port)) ||
+			(server.Pinning != nil && server.Pinning.Match(hello.ServerName)) {
+			log.Println("tls passthrough:", hello.ServerName, host, port)
+			server.mux.SpliceRawHandlerFunc(ctx, pc, host, port)
+			return
+		}
+	}
+	var clientHello = new(tls.ClientHelloInfo)
+	tlsConn := tls.Server(pc, &tls.Config{GetConfigForClient: server.GenFuncGetConfigForTargetPort(clientHello, host, port)})
+	defer tlsConn.Close()
+	err := tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		if server.Pinning != nil && certRejected(err) {
+			learned, err := server.Pinning.Failed(clientHello.ServerName)
+			if err != nil {
+				log.Printf("%+v\n", err)
+			}
+			if learned {
+				log.Println("tls pinning learned:", clientHello.ServerName)
+			}
+		}
+		log.Printf("%+v\n", xerrors.Errorf("%s: %w", clientHello.ServerName, err))
+		return
+	}
+	if server.Pinning != nil {
+		server.Pinning.Succeeded(clientHello.ServerName)
+	}
+	if tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		server.mux.HandleHTTP2(ctx, tlsConn, clientHello, host, port)
+		return
+	}
+	server.mux.HandleHTTPS(ctx, tlsConn, clientHello, host, port)
+}
+
+// sniffProtocol 预读客户端数据判断协议, 超时未收到数据视为原始数据流
+func sniffProtocol(pc *peekConn, timeout time.Duration) (protocol, error) {
+	pc.SetReadDeadline(time.Now().Add(timeout))
+	defer pc.SetReadDeadline(time.Time{})
+	for n := 1; ; n++ {
+		head, err := pc.Peek(n)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return protocolRaw, nil
+		}
+		if err != nil {
+			return protocolRaw, xerrors.Errorf("%w", err)
+		}
+		proto, ok := classifyProtocol(head)
+		if ok {
+			return proto, nil
+		}
+	}
+}
+
+// classifyProtocol 返回 false 表示数据不足以判断
+func classifyProtocol(head []byte) (protocol, bool) {
+	if head[0] == 0x16 { // TLS handshake record: 0x16 0x03 0x0X
+		if len(head) < 2 {
+			return protocolRaw, false
+		}
+		if head[1] == 0x03 {
+			return protocolTLS, true
+		}
+		return protocolRaw, true
+	}
+	for _, method := range httpMethods {
+		if len(head) < len(method) {
+			if strings.HasPrefix(method, string(head)) {
+				return protocolRaw, false
+			}
+			continue
+		}
+		if strings.HasPrefix(string(head), method) {
+			if method == "PRI " {
+				return protocolH2C, true
+			}
+			return protocolHTTP, true
+		}
+	}
+	return protocolRaw, true
+}
+
+// splice 双向转发, 一个方向结束时关闭对端的写, 两个方向都结束后关闭连接
+func splice(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+	<-done
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// pinnedUpstream 固定的上游连接, NormalRoundTrip 在请求的 ctx 中找到它时直接在该连接上收发请求
+// target 为 DialFirst 拨号的目标 host:port, 连接只给第一个发往该目标的请求使用, 其余请求 (包括被处理器改了 URL.Host 的) 正常拨号;
+// target 为空时 (BIND) 对端是唯一的上游, 所有请求都在连接上依次收发
+type pinnedUpstream struct {
+	conn   net.Conn
+	target string
+	mutex  sync.Mutex
+	used   bool
+	rw     net.Conn
+	reader *bufio.Reader
+}
+
+func withUpstreamConn(ctx context.Context, conn net.Conn, target string) context.Context {
+	return context.WithValue(ctx, upstreamContextKey, &pinnedUpstream{conn: conn, target: target})
+}
+
+// closeUpstreamConn 关闭 ctx 中固定的上游连接, 没有时什么也不做
+func closeUpstreamConn(ctx context.Context) {
+	if upstream, ok := ctx.Value(upstreamContextKey).(*pinnedUpstream); ok {
+		upstream.conn.Close()
+	}
+}
+
+// claim 判断 req 能否使用固定的连接, 有 target 时只有第一个匹配的请求能使用
+func (upstream *pinnedUpstream) claim(req *http.Request) bool {
+	if upstream.target == "" {
+		return true
+	}
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if !strings.EqualFold(net.JoinHostPort(req.URL.Hostname(), port), upstream.target) {
+		return false
+	}
+	upstream.mutex.Lock()
+	defer upstream.mutex.Unlock()
+	if upstream.used {
+		return false
+	}
+	upstream.used = true
+	return true
+}
+
+// RoundTrip 没有 target 时同一时间只有一个请求使用连接, 直到响应 body 关闭后才能发送下一个请求;
+// 有 target 时连接只用于这一个请求, 响应 body 关闭时关闭连接
+func (upstream *pinnedUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	release := func() { upstream.conn.Close() }
+	if upstream.target == "" {
+		upstream.mutex.Lock()
+		release = upstream.mutex.Unlock
+	}
+	resp, err := upstream.roundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// 升级后连接归调用方所有, 不会再有下一个请求
+		if upstream.target == "" {
+			release()
+		}
+		return resp, nil
+	}
+	resp.Body = &pinnedBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+func (upstream *pinnedUpstream) roundTrip(req *http.Request) (*http.Response, error) {
+	if upstream.rw == nil {
+		upstream.rw = upstream.conn
+		if req.URL.Scheme == "https" {
+			tlsConn := tls.Client(upstream.conn, &tls.Config{
+				ServerName:         req.URL.Hostname(),
+				InsecureSkipVerify: true,
+				NextProtos:         []string{"http/1.1"},
+			})
+			err := tlsConn.HandshakeContext(req.Context())
+			if err != nil {
+				return nil, xerrors.Errorf("%w", err)
+			}
+			upstream.rw = tlsConn
+		}
+		upstream.reader = bufio.NewReader(upstream.rw)
+	}
+	err := req.Write(upstream.rw)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	resp, err := http.ReadResponse(upstream.reader, req)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// 与 http.Transport 一致, 协议升级后 body 就是连接本身
+		resp.Body = &upgradedConn{Reader: upstream.reader, Writer: upstream.rw, Closer: upstream.rw}
+	}
+	return resp, nil
+}
+
+// pinnedBody 关闭时释放 pinnedUpstream 的锁或连接
+type pinnedBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (body *pinnedBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.once.Do(body.release)
+	return err
+}
+
+type upgradedConn struct {
+	io.Reader
+	io.Writer
+	io.Closer
+}
@@ -0,0 +1,91 @@
+package socksmitm
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClassifyProtocol(t *testing.T) {
+	cases := []struct {
+		head  string
+		proto protocol
+		ok    bool
+	}{
+		{"\x16", protocolRaw, false},
+		{"\x16\x03", protocolTLS, true},
+		{"\x16\x01", protocolRaw, true},
+		{"G", protocolRaw, false},
+		{"GET", protocolRaw, false},
+		{"GET ", protocolHTTP, true},
+		{"GETX", protocolRaw, true},
+		{"P", protocolRaw, false},
+		{"PATCH /", protocolHTTP, true},
+		{"CONNECT example.com:443", protocolHTTP, true},
+		{"PRI * HTTP/2.0", protocolH2C, true},
+		{"SSH-2.0", protocolRaw, true},
+		{"\x00\x01", protocolRaw, true},
+	}
+	for _, c := range cases {
+		proto, ok := classifyProtocol([]byte(c.head))
+		if proto != c.proto || ok != c.ok {
+			t.Errorf("classifyProtocol(%q) = %d %v, want %d %v", c.head, proto, ok, c.proto, c.ok)
+		}
+	}
+}
+
+func TestSniffProtocol(t *testing.T) {
+	cases := map[string]struct {
+		packets []string
+		proto   protocol
+	}{
+		"tls":          {[]string{"\x16\x03\x01\x02\x00"}, protocolTLS},
+		"http":         {[]string{"POST / HTTP/1.1\r\n"}, protocolHTTP},
+		"h2c":          {[]string{"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"}, protocolH2C},
+		"short packet": {[]string{"GE", "T / HTTP/1.1\r\n"}, protocolHTTP},
+		"short tls":    {[]string{"\x16", "\x03\x03"}, protocolTLS},
+		"server first": {nil, protocolRaw},
+	}
+	for name, c := range cases {
+		client, conn := net.Pipe()
+		go func(packets []string) {
+			for _, packet := range packets {
+				client.Write([]byte(packet))
+				time.Sleep(10 * time.Millisecond)
+			}
+		}(c.packets)
+		pc := newPeekConn(conn)
+		proto, err := sniffProtocol(pc, 200*time.Millisecond)
+		if err != nil || proto != c.proto {
+			t.Errorf("%s: sniffProtocol = %d %v, want %d", name, proto, err, c.proto)
+		}
+		if len(c.packets) > 0 {
+			// 嗅探不消耗数据
+			head := make([]byte, len(c.packets[0]))
+			if _, err = io.ReadFull(pc, head); err != nil || string(head) != c.packets[0] {
+				t.Errorf("%s: read after sniff %q %v", name, head, err)
+			}
+		}
+		client.Close()
+		conn.Close()
+	}
+}
+
+func TestServer_SniffTimeout(t *testing.T) {
+	server := &Server{}
+	if server.sniffTimeout() != DefaultSniffTimeout {
+		t.Errorf("default sniff timeout %s", server.sniffTimeout())
+	}
+	server.SniffTimeout = 50 * time.Millisecond
+	client, conn := net.Pipe()
+	defer client.Close()
+	start := time.Now()
+	proto, err := sniffProtocol(newPeekConn(conn), server.sniffTimeout())
+	if err != nil || proto != protocolRaw {
+		t.Errorf("sniffProtocol = %d %v", proto, err)
+	}
+	if elapsed := time.Since(start); elapsed > DefaultSniffTimeout/2 {
+		t.Errorf("sniff took %s with SniffTimeout %s", elapsed, server.SniffTimeout)
+	}
+}
@@ -0,0 +1,191 @@
+package socksmitm
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// StreamMaxCapture StreamHooks.MaxCapture 小于等于 0 时使用
+var StreamMaxCapture int64 = 1 << 20
+
+// HTTPExchange 一次经过 StreamRoundTrip 的请求, Response 在收到响应头之后才有值
+type HTTPExchange struct {
+	Request  *http.Request
+	Response *http.Response
+	// RequestBody/ResponseBody 转发的 body 的前 MaxCapture 字节, 在 Done 中使用
+	RequestBody  []byte
+	ResponseBody []byte
+	// RequestTruncated/ResponseTruncated 为 true 表示 body 超过 MaxCapture, 只捕获了前 MaxCapture 字节, 没有经过钩子的部分原样转发
+	RequestTruncated  bool
+	ResponseTruncated bool
+}
+
+// BodyChunkFunc 处理 body 的一块数据, 返回的数据替换该块: 原样返回表示不修改, 返回空表示丢弃
+// chunk 只在调用期间有效, 需要保留时应复制; 返回 error 时中断 body
+type BodyChunkFunc func(exchange *HTTPExchange, chunk []byte) ([]byte, error)
+
+// StreamHooks 字段为 nil 时不处理
+type StreamHooks struct {
+	// MaxCapture 最多捕获和处理的 body 长度, 总是捕获前 MaxCapture 字节; Content-Length 超过时整个 body 不经过钩子,
+	// 长度未知的 body 读到超过时从该块起不经过钩子
+	MaxCapture int64
+	Request    BodyChunkFunc
+	Response   BodyChunkFunc
+	// RequestTee/ResponseTee 返回接收 body 副本的 Writer, 写入的是实际转发的数据, 不受 MaxCapture 限制
+	// 写入是同步的, 慢的 Writer 会拖慢转发; 写入出错后不再写入, 实现了 io.Closer 的在 body 结束时关闭
+	RequestTee  func(exchange *HTTPExchange) io.Writer
+	ResponseTee func(exchange *HTTPExchange) io.Writer
+	// Done 响应 body 读完或关闭后调用
+	Done func(exchange *HTTPExchange)
+}
+
+// StreamRoundTrip 边转发边处理请求和响应的 body, 不整体缓存, 适用于大文件下载, SSE 和长轮询
+func StreamRoundTrip(next HTTPRoundTrip, hooks *StreamHooks) HTTPRoundTrip {
+	limit := hooks.MaxCapture
+	if limit <= 0 {
+		limit = StreamMaxCapture
+	}
+	return func(req *http.Request) (*http.Response, error) {
+		exchange := &HTTPExchange{Request: req}
+		if hasBody(req.Body) {
+			body := newStreamBody(exchange, req.Body, req.ContentLength, limit, hooks.Request, hooks.RequestTee,
+				&exchange.RequestBody, &exchange.RequestTruncated, nil)
+			req.Body = body
+			if body.hook != nil {
+				req.ContentLength = -1
+				req.Header.Del("Content-Length")
+			}
+		}
+		resp, err := next(req)
+		if err != nil {
+			return nil, xerrors.Errorf("%w", err)
+		}
+		exchange.Response = resp
+		var done func()
+		if hooks.Done != nil {
+			done = func() { hooks.Done(exchange) }
+		}
+		// 101 的 body 是升级后的连接, WebSocket 需要它的 io.ReadWriteCloser, 原样返回
+		if !hasBody(resp.Body) || resp.StatusCode == http.StatusSwitchingProtocols {
+			if done != nil {
+				done()
+			}
+			return resp, nil
+		}
+		body := newStreamBody(exchange, resp.Body, resp.ContentLength, limit, hooks.Response, hooks.ResponseTee,
+			&exchange.ResponseBody, &exchange.ResponseTruncated, done)
+		resp.Body = body
+		if body.hook != nil {
+			resp.ContentLength = -1
+			resp.Header.Del("Content-Length")
+		}
+		return resp, nil
+	}
+}
+
+func hasBody(body io.ReadCloser) bool {
+	return body != nil && body != http.NoBody
+}
+
+// streamBody 每次从原 body 读取一块, 经过钩子后返回
+type streamBody struct {
+	body      io.ReadCloser
+	exchange  *HTTPExchange
+	hook      BodyChunkFunc
+	tee       io.Writer
+	capture   *[]byte
+	truncated *bool
+	limit     int64
+	read      int64
+	buf       []byte
+	pending   []byte
+	err       error
+	done      func()
+	once      sync.Once
+}
+
+func newStreamBody(exchange *HTTPExchange, body io.ReadCloser, contentLength, limit int64, hook BodyChunkFunc,
+	tee func(*HTTPExchange) io.Writer, capture *[]byte, truncated *bool, done func()) *streamBody {
+	b := &streamBody{body: body, exchange: exchange, hook: hook, capture: capture, truncated: truncated, limit: limit, done: done}
+	if contentLength > limit {
+		*truncated = true
+		b.hook = nil
+	}
+	if tee != nil {
+		b.tee = tee(exchange)
+	}
+	return b
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	for len(b.pending) == 0 {
+		if b.err != nil {
+			b.finish()
+			return 0, b.err
+		}
+		if b.buf == nil {
+			b.buf = make([]byte, 32*1024)
+		}
+		n, err := b.body.Read(b.buf)
+		if n > 0 {
+			b.pending, b.err = b.process(b.buf[:n])
+		}
+		if b.err == nil {
+			b.err = err
+		}
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
+
+func (b *streamBody) process(chunk []byte) ([]byte, error) {
+	b.read += int64(len(chunk))
+	if b.read > b.limit {
+		*b.truncated = true
+	}
+	if b.hook != nil && !*b.truncated {
+		var err error
+		chunk, err = b.hook(b.exchange, chunk)
+		if err != nil {
+			return nil, xerrors.Errorf("%s%s: %w", b.exchange.Request.Host, b.exchange.Request.URL.Path, err)
+		}
+	}
+	// 跨过 limit 的块也保留到 limit 为止的部分
+	if room := b.limit - int64(len(*b.capture)); room > 0 {
+		*b.capture = append(*b.capture, chunk[:min(int64(len(chunk)), room)]...)
+	}
+	if b.tee != nil && len(chunk) > 0 {
+		_, err := b.tee.Write(chunk)
+		if err != nil {
+			b.closeTee()
+		}
+	}
+	return chunk, nil
+}
+
+func (b *streamBody) Close() error {
+	err := b.body.Close()
+	b.finish()
+	return err
+}
+
+// finish body 结束或关闭时只执行一次
+func (b *streamBody) finish() {
+	b.once.Do(func() {
+		b.closeTee()
+		if b.done != nil {
+			b.done()
+		}
+	})
+}
+
+func (b *streamBody) closeTee() {
+	if closer, ok := b.tee.(io.Closer); ok {
+		closer.Close()
+	}
+	b.tee = nil
+}
@@ -0,0 +1,211 @@
+package socksmitm_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lomoalbert/socksmitm"
+	"golang.org/x/net/proxy"
+)
+
+func TestStreamRoundTrip(t *testing.T) {
+	echo := func(req *http.Request) (*http.Response, error) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Length": {"9"}},
+			Body:          io.NopCloser(io.MultiReader(strings.NewReader("echo:"), bytes.NewReader(body))),
+			ContentLength: int64(5 + len(body)),
+		}, nil
+	}
+	var tee bytes.Buffer
+	var done *socksmitm.HTTPExchange
+	roundTrip := socksmitm.StreamRoundTrip(echo, &socksmitm.StreamHooks{
+		Request: func(exchange *socksmitm.HTTPExchange, chunk []byte) ([]byte, error) {
+			return bytes.ToUpper(chunk), nil
+		},
+		Response: func(exchange *socksmitm.HTTPExchange, chunk []byte) ([]byte, error) {
+			if string(chunk) == "echo:" {
+				return nil, nil
+			}
+			return chunk, nil
+		},
+		ResponseTee: func(exchange *socksmitm.HTTPExchange) io.Writer { return &tee },
+		Done:        func(exchange *socksmitm.HTTPExchange) { done = exchange },
+	})
+	resp, err := roundTrip(mustRequest(t, http.MethodPost, "http://stream.test/", "ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ContentLength != -1 || resp.Header.Get("Content-Length") != "" {
+		t.Errorf("content length %d %v", resp.ContentLength, resp.Header)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "PING" || tee.String() != "PING" {
+		t.Errorf("body %q tee %q", body, tee.String())
+	}
+	if done == nil || string(done.RequestBody) != "PING" || string(done.ResponseBody) != "PING" || done.ResponseTruncated {
+		t.Fatalf("done %+v", done)
+	}
+}
+
+func TestStreamRoundTrip_MaxCapture(t *testing.T) {
+	var hooked []string
+	hooks := &socksmitm.StreamHooks{
+		MaxCapture: 4,
+		Response: func(exchange *socksmitm.HTTPExchange, chunk []byte) ([]byte, error) {
+			hooked = append(hooked, string(chunk))
+			return bytes.ToUpper(chunk), nil
+		},
+	}
+	for _, test := range []struct {
+		contentLength int64
+		body          string
+		hooked        int
+		captured      string
+	}{
+		{contentLength: 8, body: "abcdefgh", hooked: 0, captured: "abcd"},
+		{contentLength: -1, body: "ABCdefgh", hooked: 1, captured: "ABCd"},
+	} {
+		hooked = nil
+		next := func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        make(http.Header),
+				Body:          io.NopCloser(io.MultiReader(strings.NewReader("abc"), strings.NewReader("defgh"))),
+				ContentLength: test.contentLength,
+			}, nil
+		}
+		var exchange *socksmitm.HTTPExchange
+		hooks.Done = func(e *socksmitm.HTTPExchange) { exchange = e }
+		resp, err := socksmitm.StreamRoundTrip(next, hooks)(mustRequest(t, http.MethodGet, "http://stream.test/", ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != test.body || len(hooked) != test.hooked || resp.ContentLength != test.contentLength {
+			t.Errorf("length %d: body %q hooked %q", test.contentLength, body, hooked)
+		}
+		if exchange == nil || !exchange.ResponseTruncated || string(exchange.ResponseBody) != test.captured {
+			t.Errorf("length %d: exchange %+v", test.contentLength, exchange)
+		}
+	}
+}
+
+func TestMux_HandleHTTP_EventStream(t *testing.T) {
+	mux := socksmitm.NewMux(proxy.Direct)
+	events, w := io.Pipe()
+	mux.Register("sse.test", func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			ProtoMajor:    2,
+			Header:        http.Header{"Content-Type": {"text/event-stream"}},
+			Body:          events,
+			ContentLength: -1,
+		}, nil
+	})
+	client, conn := net.Pipe()
+	defer client.Close()
+	go mux.HandleHTTP(context.Background(), conn, "192.0.2.1", 80)
+	go io.WriteString(client, "GET /events HTTP/1.1\r\nHost: sse.test\r\n\r\n")
+	go io.WriteString(w, "data: 1\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ProtoMajor != 1 || len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Fatalf("proto %s transfer encoding %v", resp.Proto, resp.TransferEncoding)
+	}
+	reader := bufio.NewReader(resp.Body)
+	for _, want := range []string{"data: 1\n", "\n", "data: 2\n"} {
+		line, err := reader.ReadString('\n')
+		if err != nil || line != want {
+			t.Fatalf("line %q %v", line, err)
+		}
+		if want == "\n" {
+			// 第一个事件已经收到后上游才发送第二个事件
+			go io.WriteString(w, "data: 2\n\n")
+		}
+	}
+	w.Close()
+}
+
+func TestStreamRoundTrip_WebSocketUpgrade(t *testing.T) {
+	mux := socksmitm.NewMux(proxy.Direct)
+	upstream, upstreamConn := net.Pipe()
+	defer upstream.Close()
+	done := make(chan struct{})
+	mux.Register("ws.test", socksmitm.StreamRoundTrip(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusSwitchingProtocols,
+			Header:     http.Header{"Upgrade": {"websocket"}, "Connection": {"Upgrade"}},
+			Body:       upstreamConn,
+		}, nil
+	}, &socksmitm.StreamHooks{Done: func(exchange *socksmitm.HTTPExchange) { close(done) }}))
+	client, conn := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	upstream.SetDeadline(time.Now().Add(5 * time.Second))
+	go mux.HandleHTTP(context.Background(), conn, "192.0.2.1", 80)
+	go io.WriteString(client, "GET /chat HTTP/1.1\r\nHost: ws.test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("response %d %v", resp.StatusCode, resp.Header)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("done not called for 101 response")
+	}
+	// 升级后的连接没有被包装, 客户端的数据原样到达上游
+	go client.Write([]byte("hello"))
+	buff := make([]byte, 5)
+	_, err = io.ReadFull(upstream, buff)
+	if err != nil || string(buff) != "hello" {
+		t.Errorf("upstream received %q %v", buff, err)
+	}
+}
+
+func TestCopyRoundTrip_LargeBody(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), int(socksmitm.StreamMaxCapture/16)+1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(io.Discard, req.Body)
+		w.Write(large)
+	}))
+	defer upstream.Close()
+	copied := make(chan [2][]byte, 1)
+	roundTrip := socksmitm.CopyRoundTrip("/upload", func(req *http.Request, reqBody []byte, resp *http.Response, respBody []byte) {
+		copied <- [2][]byte{reqBody, respBody}
+	})
+	resp, err := roundTrip(mustRequest(t, http.MethodPost, upstream.URL+"/upload", string(large)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	select {
+	case bodies := <-copied:
+		if !bytes.Equal(bodies[0], large) || !bytes.Equal(bodies[1], large) {
+			t.Errorf("copied %d/%d bytes, want %d", len(bodies[0]), len(bodies[1]), len(large))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not called")
+	}
+}
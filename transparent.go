@@ -0,0 +1,50 @@
+package socksmitm
+
+import (
+	"context"
+	"log"
+	"net"
+
+	"golang.org/x/xerrors"
+)
+
+// TransparentMode 透明代理获取原始目标地址的方式
+type TransparentMode int
+
+const (
+	// TransparentRedirect iptables -j REDIRECT, 通过 SO_ORIGINAL_DST 获取原始目标
+	TransparentRedirect TransparentMode = iota
+	// TransparentTProxy iptables -j TPROXY, 连接的本地地址即原始目标
+	TransparentTProxy
+)
+
+// RunTransparent 接受 iptables 重定向来的连接, 不经过 SOCKS 握手直接嗅探 TLS/HTTP 并交给 Mux,
+// 主机名由 SNI 或 Host 头决定
+func (server *Server) RunTransparent(ctx context.Context, addr string, mode TransparentMode) error {
+	listener, err := listenTransparent(ctx, addr, mode)
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	log.Println("transparent proxy listen:", addr)
+	return server.serveListener(ctx, listener, func(conn net.Conn) error {
+		return server.TransparentHandle(conn, mode)
+	})
+}
+
+func (server *Server) TransparentHandle(conn net.Conn, mode TransparentMode) error {
+	defer conn.Close()
+	dst, err := originalDst(conn, mode)
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && mode == TransparentRedirect && local.IP.Equal(dst.IP) && local.Port == dst.Port {
+		return xerrors.Errorf("transparent: connection to proxy itself %s", dst) // 没有经过重定向, 避免回环
+	}
+	ctx := context.Background()
+	host := dst.IP.String()
+	if server.Ruleset != nil && !server.Ruleset(ctx, 0x01, host, dst.Port) {
+		return xerrors.Errorf("connect %s rejected", dst)
+	}
+	server.serveStream(ctx, conn, host, dst.Port)
+	return nil
+}
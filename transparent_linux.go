@@ -0,0 +1,98 @@
+package socksmitm
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	soOriginalDst   = 80 // SO_ORIGINAL_DST / IP6T_SO_ORIGINAL_DST
+	ipv6Transparent = 75 // IPV6_TRANSPARENT
+)
+
+func listenTransparent(ctx context.Context, addr string, mode TransparentMode) (net.Listener, error) {
+	config := net.ListenConfig{}
+	if mode == TransparentTProxy {
+		config.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				if sockErr == nil && network == "tcp6" {
+					sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				}
+			})
+			if err != nil {
+				return xerrors.Errorf("%w", err)
+			}
+			if sockErr != nil {
+				return xerrors.Errorf("IP_TRANSPARENT: %w", sockErr)
+			}
+			return nil
+		}
+	}
+	listener, err := config.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	return listener, nil
+}
+
+// originalDst 获取被重定向连接的原始目标地址
+func originalDst(conn net.Conn, mode TransparentMode) (*net.TCPAddr, error) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, xerrors.Errorf("not a tcp connection: %s", conn.LocalAddr())
+	}
+	if mode == TransparentTProxy {
+		return local, nil
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, xerrors.Errorf("not a tcp connection: %T", conn)
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	var dst *net.TCPAddr
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			// sockaddr_in 放在 IPv6Mreq 里读出
+			var mreq *syscall.IPv6Mreq
+			mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+			if sockErr == nil {
+				dst = sockaddr4(mreq.Multiaddr)
+			}
+			return
+		}
+		// sockaddr_in6 放在 IPv6MTUInfo 里读出
+		var info *syscall.IPv6MTUInfo
+		info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+		if sockErr == nil {
+			dst = sockaddr6(&info.Addr)
+		}
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	if sockErr != nil {
+		return nil, xerrors.Errorf("SO_ORIGINAL_DST: %w", sockErr)
+	}
+	return dst, nil
+}
+
+// sockaddr4 解析 sockaddr_in: family(2) | port(2) | addr(4), 端口为网络字节序
+func sockaddr4(raw [16]byte) *net.TCPAddr {
+	return &net.TCPAddr{IP: net.IPv4(raw[4], raw[5], raw[6], raw[7]), Port: int(raw[2])<<8 | int(raw[3])}
+}
+
+// sockaddr6 解析 sockaddr_in6, Port 字段按内存中的网络字节序读取
+func sockaddr6(addr *syscall.RawSockaddrInet6) *net.TCPAddr {
+	port := (*[2]byte)(unsafe.Pointer(&addr.Port))
+	return &net.TCPAddr{IP: net.IP(append([]byte(nil), addr.Addr[:]...)), Port: int(port[0])<<8 | int(port[1])}
+}
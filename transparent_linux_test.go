@@ -0,0 +1,28 @@
+package socksmitm
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestSockaddr(t *testing.T) {
+	raw4 := [16]byte{0x02, 0x00, 0x01, 0xbb, 192, 0, 2, 1}
+	if addr := sockaddr4(raw4); addr.String() != "192.0.2.1:443" {
+		t.Errorf("sockaddr4: %s", addr)
+	}
+
+	raw6 := syscall.RawSockaddrInet6{Family: syscall.AF_INET6}
+	copy(raw6.Addr[:], net.ParseIP("2001:db8::1"))
+	port := (*[2]byte)(unsafe.Pointer(&raw6.Port))
+	port[0], port[1] = 0x1f, 0x90
+	addr := sockaddr6(&raw6)
+	if addr.String() != "[2001:db8::1]:8080" {
+		t.Errorf("sockaddr6: %s", addr)
+	}
+	raw6.Addr[15] = 2
+	if addr.IP.String() != "2001:db8::1" {
+		t.Errorf("sockaddr6 shares memory with the raw sockaddr: %s", addr.IP)
+	}
+}
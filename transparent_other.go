@@ -0,0 +1,18 @@
+//go:build !linux
+
+package socksmitm
+
+import (
+	"context"
+	"net"
+
+	"golang.org/x/xerrors"
+)
+
+func listenTransparent(ctx context.Context, addr string, mode TransparentMode) (net.Listener, error) {
+	return nil, xerrors.New("transparent proxy is only supported on linux")
+}
+
+func originalDst(conn net.Conn, mode TransparentMode) (*net.TCPAddr, error) {
+	return nil, xerrors.New("transparent proxy is only supported on linux")
+}
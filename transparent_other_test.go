@@ -0,0 +1,26 @@
+//go:build !linux
+
+package socksmitm_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/lomoalbert/socksmitm"
+)
+
+func TestServer_RunTransparentUnsupported(t *testing.T) {
+	server := &socksmitm.Server{}
+	err := server.RunTransparent(context.Background(), "127.0.0.1:0", socksmitm.TransparentRedirect)
+	if err == nil || !strings.Contains(err.Error(), "only supported on linux") {
+		t.Errorf("RunTransparent: %v", err)
+	}
+	client, conn := net.Pipe()
+	defer client.Close()
+	err = server.TransparentHandle(conn, socksmitm.TransparentTProxy)
+	if err == nil || !strings.Contains(err.Error(), "only supported on linux") {
+		t.Errorf("TransparentHandle: %v", err)
+	}
+}
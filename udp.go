@@ -0,0 +1,343 @@
+package socksmitm
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// ParseUDPDatagram 解析 RFC 1928 UDP 请求头, 返回目标地址和数据
+func ParseUDPDatagram(b []byte) (frag byte, host string, port int, data []byte, err error) {
+	//+----+------+------+----------+----------+----------+
+	//|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+	//+----+------+------+----------+----------+----------+
+	//| 2  |  1   |  1   | Variable |    2     | Variable |
+	//+----+------+------+----------+----------+----------+
+	if len(b) < 4 {
+		return 0, "", 0, nil, xerrors.Errorf("udp header: %x", b)
+	}
+	frag = b[2]
+	atyp := b[3]
+	b = b[4:]
+	switch atyp {
+	case 0x01: // IPv4
+		if len(b) < net.IPv4len+2 {
+			return 0, "", 0, nil, xerrors.Errorf("udp header: %x", b)
+		}
+		host = net.IP(b[:net.IPv4len]).String()
+		b = b[net.IPv4len:]
+	case 0x03: // 域名
+		if len(b) < 1 || len(b) < 1+int(b[0])+2 {
+			return 0, "", 0, nil, xerrors.Errorf("udp header: %x", b)
+		}
+		host = string(b[1 : 1+int(b[0])])
+		b = b[1+int(b[0]):]
+	case 0x04: // IPv6
+		if len(b) < net.IPv6len+2 {
+			return 0, "", 0, nil, xerrors.Errorf("udp header: %x", b)
+		}
+		host = net.IP(b[:net.IPv6len]).String()
+		b = b[net.IPv6len:]
+	default:
+		return 0, "", 0, nil, xerrors.Errorf("%w: %x", errAddressType, atyp)
+	}
+	port = int(binary.BigEndian.Uint16(b[:2]))
+	return frag, host, port, b[2:], nil
+}
+
+// BuildUDPDatagram 构造带 RFC 1928 UDP 请求头的数据报
+func BuildUDPDatagram(host string, port int, data []byte) []byte {
+	b := append([]byte{0x00, 0x00, 0x00}, socksAddr(host, port)...)
+	return append(b, data...)
+}
+
+// socksAddr 编码 ATYP | ADDR | PORT
+func socksAddr(host string, port int) []byte {
+	var b []byte
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		b = append([]byte{0x03, byte(len(host))}, host...)
+	case ip.To4() != nil:
+		b = append([]byte{0x01}, ip.To4()...)
+	default:
+		b = append([]byte{0x04}, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
+
+// UDPIdleTimeout UDP ASSOCIATE 中一个目标没有数据往来多久后关闭它的队列和上游连接
+var UDPIdleTimeout = 2 * time.Minute
+
+// SocksUDPAssociate 绑定 UDP 中继端口并回复 BND.ADDR/BND.PORT, TCP 控制连接关闭时结束中继
+// clientHost/clientPort 为客户端声明的发送地址, 全零表示未知
+func (server *Server) SocksUDPAssociate(ctx context.Context, conn net.Conn, clientHost string, clientPort int) error {
+	var localIP net.IP
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = addr.IP
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		socksFail(conn, RepGeneralFailure)
+		return xerrors.Errorf("%w", err)
+	}
+	defer udpConn.Close()
+	bndAddr := udpConn.LocalAddr().(*net.UDPAddr)
+	_, err = conn.Write(append([]byte{0x05, 0x00, 0x00}, socksAddr(bndAddr.IP.String(), bndAddr.Port)...))
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	relay := &udpRelay{
+		mux:         server.mux,
+		ruleset:     server.Ruleset,
+		conn:        udpConn,
+		upstreams:   make(map[string]*udpUpstream),
+		queues:      make(map[string]chan *UDPDatagram),
+		idleTimeout: UDPIdleTimeout,
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		relay.clientIP = addr.IP
+	}
+	if ip := net.ParseIP(clientHost); ip != nil && !ip.IsUnspecified() {
+		relay.clientIP = ip
+	}
+	relay.clientPort = clientPort
+	go relay.serve(ctx)
+	// 控制连接上不应再有数据, 读到 EOF 即客户端结束关联
+	_, err = io.Copy(io.Discard, conn)
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	return nil
+}
+
+type udpRelay struct {
+	mux *Mux
+	// ruleset 对每个新目标检查一次, 拒绝的目标的数据报被丢弃
+	ruleset    RulesetFunc
+	conn       *net.UDPConn
+	clientIP   net.IP
+	clientPort int
+	// idleTimeout 目标空闲超过该时间后回收队列和上游连接, 避免长时间的关联耗尽文件描述符
+	idleTimeout time.Duration
+
+	mutex      sync.Mutex
+	clientAddr *net.UDPAddr
+	upstreams  map[string]*udpUpstream
+	// queues 每个目标一个队列, 同一目标的数据报按顺序处理, 慢的目标 (DNS 解析, 拨号, 处理器) 不影响其它目标
+	queues map[string]chan *UDPDatagram
+}
+
+// udpQueueSize 每个目标排队的数据报数量, 队列满时丢弃新的数据报
+const udpQueueSize = 64
+
+// udpUpstream 发往一个目标的 UDP 连接, lastWrite 在 relay.mutex 下更新
+type udpUpstream struct {
+	net.Conn
+	lastWrite time.Time
+}
+
+func (relay *udpRelay) serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		relay.conn.Close()
+	}()
+	defer relay.closeUpstreams()
+	buff := make([]byte, 65535)
+	for {
+		n, addr, err := relay.conn.ReadFromUDP(buff)
+		if err != nil {
+			return
+		}
+		if relay.clientIP != nil && !relay.clientIP.Equal(addr.IP) {
+			continue
+		}
+		if relay.clientPort != 0 && relay.clientPort != addr.Port {
+			continue
+		}
+		frag, host, port, data, err := ParseUDPDatagram(buff[:n])
+		if err != nil {
+			log.Printf("%+v\n", err)
+			continue
+		}
+		if frag != 0x00 {
+			continue // 不支持分片, 直接丢弃
+		}
+		relay.mutex.Lock()
+		relay.clientAddr = addr
+		relay.mutex.Unlock()
+		relay.enqueue(ctx, &UDPDatagram{Client: addr, Host: host, Port: port, Payload: append([]byte(nil), data...)})
+	}
+}
+
+// enqueue 把数据报放入目标的队列, 不阻塞读取循环
+func (relay *udpRelay) enqueue(ctx context.Context, datagram *UDPDatagram) {
+	key := net.JoinHostPort(datagram.Host, strconv.Itoa(datagram.Port))
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	queue, ok := relay.queues[key]
+	if !ok {
+		queue = make(chan *UDPDatagram, udpQueueSize)
+		relay.queues[key] = queue
+		go relay.process(ctx, key, queue)
+	}
+	// 持有锁放入, process 在锁内确认队列为空后才回收
+	select {
+	case queue <- datagram:
+	default:
+		log.Println("udp queue full, drop datagram to:", key)
+	}
+}
+
+func (relay *udpRelay) process(ctx context.Context, key string, queue chan *UDPDatagram) {
+	timer := time.NewTimer(relay.idleTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case datagram := <-queue:
+			relay.dispatch(ctx, datagram)
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(relay.idleTimeout)
+		case <-timer.C:
+			relay.mutex.Lock()
+			if len(queue) == 0 {
+				delete(relay.queues, key)
+				relay.mutex.Unlock()
+				return
+			}
+			relay.mutex.Unlock()
+			timer.Reset(relay.idleTimeout)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// dispatch 交给 Mux 处理, 再按 Reply 发回客户端或转发到目标
+func (relay *udpRelay) dispatch(ctx context.Context, datagram *UDPDatagram) {
+	datagrams, err := relay.mux.UDPHandle(ctx, datagram)
+	if err != nil {
+		log.Printf("%+v\n", err)
+		return
+	}
+	for _, d := range datagrams {
+		if d.Reply {
+			err = relay.writeToClient(d.Host, d.Port, d.Payload)
+		} else {
+			err = relay.forward(ctx, d.Host, d.Port, d.Payload)
+		}
+		if err != nil {
+			log.Printf("%+v\n", err)
+		}
+	}
+}
+
+func (relay *udpRelay) forward(ctx context.Context, host string, port int, data []byte) error {
+	key := net.JoinHostPort(host, strconv.Itoa(port))
+	relay.mutex.Lock()
+	upstream, ok := relay.upstreams[key]
+	if ok {
+		upstream.lastWrite = time.Now()
+	}
+	relay.mutex.Unlock()
+	if !ok {
+		if relay.ruleset != nil && !relay.ruleset(ctx, 0x03, host, port) {
+			return xerrors.Errorf("udp %s rejected", key)
+		}
+		// 拨号 (可能包括 DNS 解析) 时不持有锁, 同时拨号的目标只保留先放入的连接
+		dialed, err := relay.mux.DialContext(ctx, "udp", key)
+		if err != nil {
+			return xerrors.Errorf("%w", err)
+		}
+		relay.mutex.Lock()
+		if ctx.Err() != nil {
+			// 关联已经结束, closeUpstreams 不会再关闭新放入的连接
+			relay.mutex.Unlock()
+			dialed.Close()
+			return xerrors.Errorf("%w", ctx.Err())
+		}
+		upstream, ok = relay.upstreams[key]
+		if !ok {
+			upstream = &udpUpstream{Conn: dialed}
+			relay.upstreams[key] = upstream
+		}
+		upstream.lastWrite = time.Now()
+		relay.mutex.Unlock()
+		if ok {
+			dialed.Close()
+		} else {
+			go relay.readUpstream(ctx, key, upstream, host, port)
+		}
+	}
+	_, err := upstream.Write(data)
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	return nil
+}
+
+// readUpstream 把目标的回复交给 Mux, 读写都空闲超过 idleTimeout 时关闭连接
+func (relay *udpRelay) readUpstream(ctx context.Context, key string, upstream *udpUpstream, host string, port int) {
+	buff := make([]byte, 65535)
+	for {
+		upstream.SetReadDeadline(time.Now().Add(relay.idleTimeout))
+		n, err := upstream.Read(buff)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && !relay.expire(key, upstream) {
+				continue
+			}
+			return
+		}
+		relay.mutex.Lock()
+		clientAddr := relay.clientAddr
+		relay.mutex.Unlock()
+		relay.dispatch(ctx, &UDPDatagram{Client: clientAddr, Host: host, Port: port, Payload: append([]byte(nil), buff[:n]...), Reply: true})
+	}
+}
+
+// expire 上游在 idleTimeout 内没有写入时移除并关闭它
+func (relay *udpRelay) expire(key string, upstream *udpUpstream) bool {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	if time.Since(upstream.lastWrite) < relay.idleTimeout {
+		return false
+	}
+	if relay.upstreams[key] == upstream {
+		delete(relay.upstreams, key)
+	}
+	upstream.Close()
+	return true
+}
+
+func (relay *udpRelay) writeToClient(host string, port int, data []byte) error {
+	relay.mutex.Lock()
+	clientAddr := relay.clientAddr
+	relay.mutex.Unlock()
+	_, err := relay.conn.WriteToUDP(BuildUDPDatagram(host, port, data), clientAddr)
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	return nil
+}
+
+func (relay *udpRelay) closeUpstreams() {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	for _, upstream := range relay.upstreams {
+		upstream.Close()
+	}
+}
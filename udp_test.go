@@ -0,0 +1,217 @@
+package socksmitm_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lomoalbert/socksmitm"
+	"golang.org/x/net/proxy"
+)
+
+func TestUDPDatagram(t *testing.T) {
+	for _, host := range []string{"8.8.8.8", "2001:db8::1", "example.com"} {
+		b := socksmitm.BuildUDPDatagram(host, 53, []byte("query"))
+		frag, h, port, data, err := socksmitm.ParseUDPDatagram(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frag != 0 || h != host || port != 53 || !bytes.Equal(data, []byte("query")) {
+			t.Errorf("%s: got %d %s %d %q", host, frag, h, port, data)
+		}
+	}
+	_, _, _, _, err := socksmitm.ParseUDPDatagram([]byte{0x00, 0x00, 0x00, 0x03, 0x10, 'a'})
+	if err == nil {
+		t.Error("expected error for truncated domain")
+	}
+}
+
+func TestMux_UDPHandle(t *testing.T) {
+	mux := socksmitm.NewMux(proxy.Direct)
+	mux.RegisterUDP("dns.test", socksmitm.UDPHandlerFunc(func(ctx context.Context, datagram *socksmitm.UDPDatagram) ([]*socksmitm.UDPDatagram, error) {
+		reply := *datagram
+		reply.Payload = []byte("answer")
+		reply.Reply = true
+		return []*socksmitm.UDPDatagram{&reply}, nil
+	}))
+	datagrams, err := mux.UDPHandle(context.Background(), &socksmitm.UDPDatagram{Host: "dns.test", Port: 53, Payload: []byte("query")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(datagrams) != 1 || !datagrams[0].Reply || string(datagrams[0].Payload) != "answer" {
+		t.Errorf("mocked: %+v", datagrams)
+	}
+	datagrams, err = mux.UDPHandle(context.Background(), &socksmitm.UDPDatagram{Host: "other.test", Port: 53, Payload: []byte("query")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(datagrams) != 1 || datagrams[0].Reply || string(datagrams[0].Payload) != "query" {
+		t.Errorf("forwarded: %+v", datagrams)
+	}
+}
+
+func TestServer_SocksUDPAssociate(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buff := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buff)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(append([]byte("echo:"), buff[:n]...), addr)
+		}
+	}()
+	mux := socksmitm.NewMux(proxy.Direct)
+	release := make(chan struct{})
+	defer close(release)
+	// slow.test 的处理器一直阻塞, 不应影响发往其它目标的数据报
+	mux.RegisterUDP("slow.test", socksmitm.UDPHandlerFunc(func(ctx context.Context, datagram *socksmitm.UDPDatagram) ([]*socksmitm.UDPDatagram, error) {
+		<-release
+		return nil, nil
+	}))
+	ca, key := newTestCA(t)
+	server, err := socksmitm.NewSocks5ServerWithCA(mux, ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := startTestAssociate(t, server)
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	relay.Write(socksmitm.BuildUDPDatagram("slow.test", 53, []byte("stuck")))
+	relay.Write(socksmitm.BuildUDPDatagram(echoAddr.IP.String(), echoAddr.Port, []byte("ping")))
+	relay.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buff := make([]byte, 1500)
+	n, err := relay.Read(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, host, port, data, err := socksmitm.ParseUDPDatagram(buff[:n])
+	if err != nil || host != echoAddr.IP.String() || port != echoAddr.Port || string(data) != "echo:ping" {
+		t.Errorf("reply from %s:%d %q %v", host, port, data, err)
+	}
+}
+
+// startTestAssociate 建立 UDP ASSOCIATE, 返回连到中继端口的 UDP 连接
+func startTestAssociate(t *testing.T, server *socksmitm.Server) *net.UDPConn {
+	conn, err := net.Dial("tcp", startTestServer(t, server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.Write([]byte{0x05, 0x01, 0x00})
+	reply := make([]byte, 10)
+	io.ReadFull(conn, reply[:2])
+	conn.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	_, err = io.ReadFull(conn, reply)
+	if err != nil || reply[1] != socksmitm.RepSucceeded || reply[3] != 0x01 {
+		t.Fatalf("associate reply %x %v", reply, err)
+	}
+	relay, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { relay.Close() })
+	return relay
+}
+
+func TestServer_SocksUDPAssociateIdle(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	sources := make(chan string, 2)
+	go func() {
+		buff := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buff)
+			if err != nil {
+				return
+			}
+			sources <- addr.String()
+			echo.WriteTo(buff[:n], addr)
+		}
+	}()
+	defer func(timeout time.Duration) { socksmitm.UDPIdleTimeout = timeout }(socksmitm.UDPIdleTimeout)
+	socksmitm.UDPIdleTimeout = 100 * time.Millisecond
+	ca, key := newTestCA(t)
+	server, err := socksmitm.NewSocks5ServerWithCA(socksmitm.NewMux(proxy.Direct), ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := startTestAssociate(t, server)
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	buff := make([]byte, 1500)
+	for i := 0; i < 2; i++ {
+		relay.Write(socksmitm.BuildUDPDatagram(echoAddr.IP.String(), echoAddr.Port, []byte("ping")))
+		relay.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = relay.Read(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 超过空闲时间后上游连接应已关闭, 下一个数据报从新的端口发出
+		time.Sleep(500 * time.Millisecond)
+	}
+	first, second := <-sources, <-sources
+	if first == second {
+		t.Errorf("idle upstream %s was reused", first)
+	}
+}
+
+func TestServer_SocksUDPAssociateRuleset(t *testing.T) {
+	blocked, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocked.Close()
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buff := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buff)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buff[:n], addr)
+		}
+	}()
+	blockedAddr := blocked.LocalAddr().(*net.UDPAddr)
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	ca, key := newTestCA(t)
+	server, err := socksmitm.NewSocks5ServerWithCA(socksmitm.NewMux(proxy.Direct), ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 关联本身声明的地址是全零, 只有数据报的目标才会被拒绝
+	server.Ruleset = func(ctx context.Context, cmd byte, host string, port int) bool {
+		return cmd != 0x03 || port != blockedAddr.Port
+	}
+	relay := startTestAssociate(t, server)
+	relay.Write(socksmitm.BuildUDPDatagram(blockedAddr.IP.String(), blockedAddr.Port, []byte("leak")))
+	relay.Write(socksmitm.BuildUDPDatagram(echoAddr.IP.String(), echoAddr.Port, []byte("ping")))
+	relay.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buff := make([]byte, 1500)
+	n, err := relay.Read(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, port, data, err := socksmitm.ParseUDPDatagram(buff[:n])
+	if err != nil || port != echoAddr.Port || string(data) != "ping" {
+		t.Errorf("reply from port %d %q %v", port, data, err)
+	}
+	blocked.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err := blocked.ReadFrom(buff); err == nil {
+		t.Errorf("rejected destination received %q", buff[:n])
+	}
+}
@@ -0,0 +1,449 @@
+package socksmitm
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// WebSocketMaxMessageSize 合并分片并解压后单条消息的最大长度
+var WebSocketMaxMessageSize = 16 << 20
+
+// WebSocket 操作码
+const (
+	WebSocketContinuation = 0x0
+	WebSocketText         = 0x1
+	WebSocketBinary       = 0x2
+	WebSocketClose        = 0x8
+	WebSocketPing         = 0x9
+	WebSocketPong         = 0xA
+)
+
+// WebSocketMessage 一条完整的文本或二进制消息, 分片已合并, permessage-deflate 已解压
+type WebSocketMessage struct {
+	Opcode int
+	Data   []byte
+	// FromClient 为 true 表示客户端发往服务端的消息
+	FromClient bool
+}
+
+// WebSocketHandler 对每条消息调用一次, 返回的消息按 FromClient 发往服务端或客户端: 原样返回表示不修改, 返回空表示丢弃
+// 返回 error 时关闭连接; 控制帧 (ping/pong/close) 不经过 WebSocketHandler, 直接转发
+type WebSocketHandler func(session *WebSocketSession, message *WebSocketMessage) ([]*WebSocketMessage, error)
+
+// WebSocketHandlerMap 键为 "host/path" 或 "host"
+type WebSocketHandlerMap map[string]WebSocketHandler
+
+// WebSocketSession 一个被拦截的 WebSocket 连接, WriteToClient/WriteToServer 可以在任意时刻插入消息
+type WebSocketSession struct {
+	Request  *http.Request
+	Response *http.Response
+	handler  WebSocketHandler
+	client   *wsLeg
+	server   *wsLeg
+}
+
+// wsLeg WebSocket 连接的一端: 客户端一侧我们是服务端, 发送不加掩码; 服务端一侧我们是客户端, 发送加掩码
+type wsLeg struct {
+	reader   *bufio.Reader
+	writer   io.WriteCloser
+	mutex    sync.Mutex
+	mask     bool
+	deflate  bool
+	compress bool
+	dict     []byte
+}
+
+type wsFrame struct {
+	fin     bool
+	rsv1    bool
+	opcode  int
+	payload []byte
+}
+
+func (session *WebSocketSession) WriteToClient(message *WebSocketMessage) error {
+	return session.client.writeMessage(message)
+}
+
+func (session *WebSocketSession) WriteToServer(message *WebSocketMessage) error {
+	return session.server.writeMessage(message)
+}
+
+// isWebSocketUpgrade 判断是否是 WebSocket 握手请求
+func isWebSocketUpgrade(req *http.Request) bool {
+	return headerContainsToken(req.Header, "Connection", "upgrade") && strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// webSocketHandler 按 "host/path", "host", 默认处理器的顺序查找, host 可以带或不带端口
+func (mux *Mux) webSocketHandler(req *http.Request) WebSocketHandler {
+	hostname := req.Host
+	if host, _, err := net.SplitHostPort(req.Host); err == nil {
+		hostname = host
+	}
+	for _, key := range []string{req.Host + req.URL.Path, hostname + req.URL.Path, req.Host, hostname} {
+		if handler, ok := mux.WebSocketHandlerMap[key]; ok && handler != nil {
+			return handler
+		}
+	}
+	return mux.DefaultWebSocketHandler
+}
+
+// ServeWebSocket 通过 HTTP 处理器完成上游握手, 把 101 响应写回客户端后双向转发帧
+// 没有 WebSocketHandler 时原样转发数据; 有处理器时解析帧, 两端分别协商 permessage-deflate
+func (mux *Mux) ServeWebSocket(ctx context.Context, conn net.Conn, reader *bufio.Reader, req *http.Request, scheme string) error {
+	handler := mux.webSocketHandler(req)
+	clientOffer, clientOffered := findExtension(req.Header, "permessage-deflate")
+	if handler != nil {
+		req.Header.Del("Sec-WebSocket-Extensions")
+		if clientOffered {
+			req.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate; client_no_context_takeover")
+		}
+	}
+	resp, err := mux.RoundTrip(ctx, req, scheme)
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		err = resp.Write(conn)
+		if err != nil {
+			return xerrors.Errorf("%w", err)
+		}
+		return nil
+	}
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		return xerrors.Errorf("websocket %s%s: response body is not writable", req.Host, req.URL.Path)
+	}
+	defer upstream.Close()
+	defer conn.Close()
+
+	header := resp.Header.Clone()
+	session := &WebSocketSession{
+		Request:  req,
+		Response: resp,
+		handler:  handler,
+		client:   &wsLeg{reader: reader, writer: conn},
+		server:   &wsLeg{reader: bufio.NewReader(upstream), writer: upstream, mask: true},
+	}
+	if handler != nil {
+		serverParams, serverAccepted := findExtension(resp.Header, "permessage-deflate")
+		session.server.deflate = serverAccepted
+		session.server.compress = serverAccepted && windowBitsAllowed(serverParams, "client_max_window_bits")
+		header.Del("Sec-WebSocket-Extensions")
+		if clientOffered {
+			extension := "permessage-deflate; server_no_context_takeover"
+			if bits, ok := clientOffer["server_max_window_bits"]; ok && bits != "" {
+				extension += "; server_max_window_bits=" + bits
+			}
+			header.Set("Sec-WebSocket-Extensions", extension)
+			session.client.deflate = true
+			session.client.compress = windowBitsAllowed(clientOffer, "server_max_window_bits")
+		}
+	}
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\n")
+	if err == nil {
+		err = header.Write(conn)
+	}
+	if err == nil {
+		_, err = io.WriteString(conn, "\r\n")
+	}
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+
+	done := make(chan error, 2)
+	go func() { done <- session.relay(session.client, session.server, true) }()
+	go func() { done <- session.relay(session.server, session.client, false) }()
+	err = <-done
+	conn.Close()
+	upstream.Close()
+	<-done
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		return xerrors.Errorf("%w", err)
+	}
+	return nil
+}
+
+// relay 从 src 读取帧写到 dst, 没有处理器时原样复制
+func (session *WebSocketSession) relay(src, dst *wsLeg, fromClient bool) error {
+	if session.handler == nil {
+		_, err := io.Copy(dst.writer, src.reader)
+		if err != nil {
+			return xerrors.Errorf("%w", err)
+		}
+		return io.EOF
+	}
+	var message *WebSocketMessage
+	var compressed bool
+	for {
+		frame, err := src.readFrame()
+		if err != nil {
+			return err
+		}
+		switch {
+		case frame.opcode > WebSocketBinary && frame.opcode < WebSocketClose, frame.opcode > WebSocketPong:
+			return session.fail(wsCloseProtocolError, fmt.Sprintf("reserved opcode 0x%x", frame.opcode))
+		case frame.opcode >= WebSocketClose && !frame.fin:
+			return session.fail(wsCloseProtocolError, "fragmented control frame")
+		case frame.opcode >= WebSocketClose:
+			err = dst.writeFrame(frame)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if frame.opcode == WebSocketContinuation {
+			if message == nil {
+				return session.fail(wsCloseProtocolError, "continuation frame without message")
+			}
+			message.Data = append(message.Data, frame.payload...)
+		} else {
+			if message != nil {
+				return session.fail(wsCloseProtocolError, "new message before previous message finished")
+			}
+			message = &WebSocketMessage{Opcode: frame.opcode, Data: frame.payload, FromClient: fromClient}
+			compressed = frame.rsv1 && src.deflate
+		}
+		if len(message.Data) > WebSocketMaxMessageSize {
+			return xerrors.Errorf("websocket: message too large: %d", len(message.Data))
+		}
+		if !frame.fin {
+			continue
+		}
+		if compressed {
+			message.Data, err = src.inflate(message.Data)
+			if err != nil {
+				return err
+			}
+		}
+		messages, err := session.handler(session, message)
+		if err != nil {
+			return xerrors.Errorf("%w", err)
+		}
+		for _, m := range messages {
+			leg := session.client
+			if m.FromClient {
+				leg = session.server
+			}
+			err = leg.writeMessage(m)
+			if err != nil {
+				return err
+			}
+		}
+		message = nil
+	}
+}
+
+// wsCloseProtocolError 关闭码 1002: 对端违反协议
+const wsCloseProtocolError = 1002
+
+// fail 向两端发送关闭帧后结束转发 (RFC 6455 7.1.7 Fail the WebSocket Connection)
+func (session *WebSocketSession) fail(code int, reason string) error {
+	payload := append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+	session.client.writeFrame(&wsFrame{fin: true, opcode: WebSocketClose, payload: payload})
+	session.server.writeFrame(&wsFrame{fin: true, opcode: WebSocketClose, payload: payload})
+	return xerrors.Errorf("websocket: %s", reason)
+}
+
+func (leg *wsLeg) readFrame() (*wsFrame, error) {
+	var head [2]byte
+	_, err := io.ReadFull(leg.reader, head[:])
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	frame := &wsFrame{fin: head[0]&0x80 != 0, rsv1: head[0]&0x40 != 0, opcode: int(head[0] & 0x0F)}
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var b [2]byte
+		_, err = io.ReadFull(leg.reader, b[:])
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		_, err = io.ReadFull(leg.reader, b[:])
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	if length > uint64(WebSocketMaxMessageSize) {
+		return nil, xerrors.Errorf("websocket: frame too large: %d", length)
+	}
+	var maskKey [4]byte
+	masked := head[1]&0x80 != 0
+	if masked {
+		_, err = io.ReadFull(leg.reader, maskKey[:])
+		if err != nil {
+			return nil, xerrors.Errorf("%w", err)
+		}
+	}
+	frame.payload = make([]byte, length)
+	_, err = io.ReadFull(leg.reader, frame.payload)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	if masked {
+		for i := range frame.payload {
+			frame.payload[i] ^= maskKey[i%4]
+		}
+	}
+	return frame, nil
+}
+
+func (leg *wsLeg) writeFrame(frame *wsFrame) error {
+	leg.mutex.Lock()
+	defer leg.mutex.Unlock()
+	return leg.writeFrameLocked(frame)
+}
+
+func (leg *wsLeg) writeFrameLocked(frame *wsFrame) error {
+	var buf bytes.Buffer
+	b0 := byte(frame.opcode)
+	if frame.fin {
+		b0 |= 0x80
+	}
+	if frame.rsv1 {
+		b0 |= 0x40
+	}
+	buf.WriteByte(b0)
+	var maskBit byte
+	if leg.mask {
+		maskBit = 0x80
+	}
+	length := len(frame.payload)
+	switch {
+	case length < 126:
+		buf.WriteByte(maskBit | byte(length))
+	case length <= 0xFFFF:
+		buf.WriteByte(maskBit | 126)
+		binary.Write(&buf, binary.BigEndian, uint16(length))
+	default:
+		buf.WriteByte(maskBit | 127)
+		binary.Write(&buf, binary.BigEndian, uint64(length))
+	}
+	payload := frame.payload
+	if leg.mask {
+		var maskKey [4]byte
+		_, err := rand.Read(maskKey[:])
+		if err != nil {
+			return xerrors.Errorf("%w", err)
+		}
+		buf.Write(maskKey[:])
+		payload = make([]byte, length)
+		for i := range payload {
+			payload[i] = frame.payload[i] ^ maskKey[i%4]
+		}
+	}
+	buf.Write(payload)
+	_, err := leg.writer.Write(buf.Bytes())
+	if err != nil {
+		return xerrors.Errorf("%w", err)
+	}
+	return nil
+}
+
+// writeMessage 以单个帧发送消息, 协商了 permessage-deflate 且窗口允许时压缩
+func (leg *wsLeg) writeMessage(message *WebSocketMessage) error {
+	frame := &wsFrame{fin: true, opcode: message.Opcode, payload: message.Data}
+	if leg.compress && message.Opcode < WebSocketClose {
+		payload, err := deflateMessage(message.Data)
+		if err != nil {
+			return err
+		}
+		frame.rsv1 = true
+		frame.payload = payload
+	}
+	return leg.writeFrame(frame)
+}
+
+// inflate 解压一条消息; 保留最近 32KB 的输出作为字典, 对端使用 context takeover 时也能正确解压
+func (leg *wsLeg) inflate(data []byte) ([]byte, error) {
+	// 0x00 0x00 0xff 0xff 为被去掉的 sync flush 尾部, 其后补一个空的最终块使读取以 EOF 结束
+	tail := []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+	r := flate.NewReaderDict(io.MultiReader(bytes.NewReader(data), bytes.NewReader(tail)), leg.dict)
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, int64(WebSocketMaxMessageSize)+1))
+	if err != nil {
+		return nil, xerrors.Errorf("websocket inflate: %w", err)
+	}
+	if len(out) > WebSocketMaxMessageSize {
+		return nil, xerrors.Errorf("websocket: message too large: %d", len(out))
+	}
+	leg.dict = append(leg.dict, out...)
+	if len(leg.dict) > 32768 {
+		leg.dict = append([]byte(nil), leg.dict[len(leg.dict)-32768:]...)
+	}
+	return out, nil
+}
+
+// deflateMessage 每条消息单独压缩 (no_context_takeover), 去掉 sync flush 的尾部
+func deflateMessage(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	_, err = fw.Write(data)
+	if err == nil {
+		err = fw.Flush()
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("%w", err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{0x00, 0x00, 0xff, 0xff}), nil
+}
+
+// findExtension 返回 Sec-WebSocket-Extensions 中第一个名为 name 的扩展的参数
+func findExtension(header http.Header, name string) (map[string]string, bool) {
+	for _, value := range header.Values("Sec-WebSocket-Extensions") {
+		for _, extension := range strings.Split(value, ",") {
+			parts := strings.Split(extension, ";")
+			if !strings.EqualFold(strings.TrimSpace(parts[0]), name) {
+				continue
+			}
+			params := make(map[string]string)
+			for _, param := range parts[1:] {
+				key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				params[strings.ToLower(key)] = strings.Trim(value, `"`)
+			}
+			return params, true
+		}
+	}
+	return nil, false
+}
+
+// windowBitsAllowed compress/flate 总是使用 32KB 窗口, 对端要求更小的窗口时不压缩, 直接发送未压缩的消息
+func windowBitsAllowed(params map[string]string, key string) bool {
+	value, ok := params[key]
+	if !ok || value == "" {
+		return true
+	}
+	bits, err := strconv.Atoi(value)
+	return err == nil && bits >= 15
+}
@@ -0,0 +1,283 @@
+package socksmitm_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lomoalbert/socksmitm"
+	"golang.org/x/net/proxy"
+)
+
+func TestMux_ServeWebSocket(t *testing.T) {
+	mux := socksmitm.NewMux(proxy.Direct)
+	upstream, upstreamConn := net.Pipe()
+	defer upstream.Close()
+	var offered string
+	mux.Register("ws.test", func(req *http.Request) (*http.Response, error) {
+		offered = req.Header.Get("Sec-WebSocket-Extensions")
+		return &http.Response{
+			StatusCode: http.StatusSwitchingProtocols,
+			Header: http.Header{
+				"Upgrade":                  {"websocket"},
+				"Connection":               {"Upgrade"},
+				"Sec-Websocket-Extensions": {"permessage-deflate"},
+			},
+			Body: upstreamConn,
+		}, nil
+	})
+	var hooked []string
+	mux.RegisterWebSocket("ws.test/chat", func(session *socksmitm.WebSocketSession, message *socksmitm.WebSocketMessage) ([]*socksmitm.WebSocketMessage, error) {
+		hooked = append(hooked, string(message.Data))
+		if message.Opcode == socksmitm.WebSocketBinary {
+			return nil, nil
+		}
+		if message.FromClient {
+			err := session.WriteToClient(&socksmitm.WebSocketMessage{Opcode: socksmitm.WebSocketText, Data: []byte("injected")})
+			if err != nil {
+				return nil, err
+			}
+			message.Data = append(message.Data, " world"...)
+		}
+		return []*socksmitm.WebSocketMessage{message}, nil
+	})
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go mux.HandleHTTP(context.Background(), conn, "192.0.2.1", 80)
+	_, err := io.WriteString(client, "GET /chat HTTP/1.1\r\nHost: ws.test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(client)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Extensions") != "permessage-deflate; server_no_context_takeover" {
+		t.Fatalf("response %d %v", resp.StatusCode, resp.Header)
+	}
+	if offered != "permessage-deflate; client_no_context_takeover" {
+		t.Errorf("offered %q", offered)
+	}
+
+	writeTestFrame(t, client, socksmitm.WebSocketText, testDeflate(t, "hello"), true, true)
+	if opcode, data := readTestFrame(t, reader); opcode != socksmitm.WebSocketText || data != "injected" {
+		t.Errorf("client got %d %q", opcode, data)
+	}
+	if opcode, data := readTestFrame(t, bufio.NewReader(upstream)); opcode != socksmitm.WebSocketText || data != "hello world" {
+		t.Errorf("upstream got %d %q", opcode, data)
+	}
+	writeTestFrame(t, upstream, socksmitm.WebSocketBinary, []byte("dropped"), false, false)
+	writeTestFrame(t, upstream, socksmitm.WebSocketText, testDeflate(t, "pong"), false, true)
+	if opcode, data := readTestFrame(t, reader); opcode != socksmitm.WebSocketText || data != "pong" {
+		t.Errorf("client got %d %q", opcode, data)
+	}
+	if len(hooked) != 3 || hooked[0] != "hello" || hooked[1] != "dropped" || hooked[2] != "pong" {
+		t.Errorf("hooked %q", hooked)
+	}
+}
+
+// startTestWebSocket 完成握手, 返回客户端连接和上游连接; 上游同意 permessage-deflate, 客户端不请求压缩
+func startTestWebSocket(t *testing.T, handler socksmitm.WebSocketHandler) (net.Conn, *bufio.Reader, net.Conn) {
+	mux := socksmitm.NewMux(proxy.Direct)
+	upstream, upstreamConn := net.Pipe()
+	t.Cleanup(func() { upstream.Close() })
+	mux.Register("ws.test", func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusSwitchingProtocols,
+			Header: http.Header{
+				"Upgrade":                  {"websocket"},
+				"Connection":               {"Upgrade"},
+				"Sec-Websocket-Extensions": {"permessage-deflate"},
+			},
+			Body: upstreamConn,
+		}, nil
+	})
+	mux.RegisterWebSocket("ws.test/chat", handler)
+	client, conn := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go mux.HandleHTTP(context.Background(), conn, "192.0.2.1", 80)
+	_, err := io.WriteString(client, "GET /chat HTTP/1.1\r\nHost: ws.test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(client)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("response %d %v", resp.StatusCode, resp.Header)
+	}
+	// 期望的帧没有到达时读取失败, 而不是一直等待
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	upstream.SetDeadline(time.Now().Add(5 * time.Second))
+	return client, reader, upstream
+}
+
+func TestMux_ServeWebSocket_Fragmented(t *testing.T) {
+	var hooked []string
+	client, reader, upstream := startTestWebSocket(t, func(session *socksmitm.WebSocketSession, message *socksmitm.WebSocketMessage) ([]*socksmitm.WebSocketMessage, error) {
+		hooked = append(hooked, string(message.Data))
+		return []*socksmitm.WebSocketMessage{message}, nil
+	})
+	go func() {
+		writeTestFragment(t, client, socksmitm.WebSocketText, []byte("hel"), false, true, false)
+		writeTestFragment(t, client, socksmitm.WebSocketPing, []byte("p"), true, true, false)
+		writeTestFragment(t, client, socksmitm.WebSocketContinuation, []byte("lo"), false, true, false)
+		writeTestFragment(t, client, socksmitm.WebSocketContinuation, []byte(" world"), true, true, false)
+	}()
+	upstreamReader := bufio.NewReader(upstream)
+	// 分片之间的控制帧直接转发, 分片合并为一条消息
+	if opcode, data := readTestFrame(t, upstreamReader); opcode != socksmitm.WebSocketPing || data != "p" {
+		t.Errorf("upstream got %d %q", opcode, data)
+	}
+	if opcode, data := readTestFrame(t, upstreamReader); opcode != socksmitm.WebSocketText || data != "hello world" {
+		t.Errorf("upstream got %d %q", opcode, data)
+	}
+	if len(hooked) != 1 || hooked[0] != "hello world" {
+		t.Errorf("hooked %q", hooked)
+	}
+	// 服务端发来的分片消息
+	go func() {
+		writeTestFragment(t, upstream, socksmitm.WebSocketBinary, []byte{1, 2}, false, false, false)
+		writeTestFragment(t, upstream, socksmitm.WebSocketContinuation, []byte{3}, true, false, false)
+	}()
+	if opcode, data := readTestFrame(t, reader); opcode != socksmitm.WebSocketBinary || data != "\x01\x02\x03" {
+		t.Errorf("client got %d %q", opcode, data)
+	}
+}
+
+func TestMux_ServeWebSocket_ContextTakeover(t *testing.T) {
+	client, reader, upstream := startTestWebSocket(t, func(session *socksmitm.WebSocketSession, message *socksmitm.WebSocketMessage) ([]*socksmitm.WebSocketMessage, error) {
+		return []*socksmitm.WebSocketMessage{message}, nil
+	})
+	defer client.Close()
+	// 上游没有声明 server_no_context_takeover, 两条消息共用一个压缩器, 第二条引用第一条的内容
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	text := "context takeover context takeover"
+	var payloads [][]byte
+	for i := 0; i < 2; i++ {
+		fw.Write([]byte(text))
+		fw.Flush()
+		payloads = append(payloads, bytes.TrimSuffix(append([]byte(nil), buf.Bytes()...), []byte{0x00, 0x00, 0xff, 0xff}))
+		buf.Reset()
+	}
+	if len(payloads[1]) >= len(payloads[0]) {
+		t.Fatalf("second message does not use the shared window: %d >= %d", len(payloads[1]), len(payloads[0]))
+	}
+	go func() {
+		for _, payload := range payloads {
+			writeTestFrame(t, upstream, socksmitm.WebSocketText, payload, false, true)
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		if opcode, data := readTestFrame(t, reader); opcode != socksmitm.WebSocketText || data != text {
+			t.Errorf("message %d: client got %d %q", i, opcode, data)
+		}
+	}
+}
+
+func TestMux_ServeWebSocket_ReservedOpcode(t *testing.T) {
+	client, reader, upstream := startTestWebSocket(t, func(session *socksmitm.WebSocketSession, message *socksmitm.WebSocketMessage) ([]*socksmitm.WebSocketMessage, error) {
+		return []*socksmitm.WebSocketMessage{message}, nil
+	})
+	go writeTestFrame(t, client, 0x3, []byte("reserved"), true, false)
+	// 先通知发送方, 再通知另一端
+	for i, r := range []io.Reader{reader, upstream} {
+		name := []string{"client", "upstream"}[i]
+		opcode, data := readTestFrame(t, r)
+		if opcode != socksmitm.WebSocketClose || len(data) < 2 || binary.BigEndian.Uint16([]byte(data)) != 1002 {
+			t.Errorf("%s got %d %q, want close 1002", name, opcode, data)
+		}
+	}
+}
+
+func writeTestFrame(t *testing.T, w io.Writer, opcode int, payload []byte, mask, compressed bool) {
+	writeTestFragment(t, w, opcode, payload, true, mask, compressed)
+}
+
+func writeTestFragment(t *testing.T, w io.Writer, opcode int, payload []byte, fin, mask, compressed bool) {
+	b0 := byte(opcode)
+	if fin {
+		b0 |= 0x80
+	}
+	if compressed {
+		b0 |= 0x40
+	}
+	frame := []byte{b0, byte(len(payload))}
+	if mask {
+		key := []byte{1, 2, 3, 4}
+		frame[1] |= 0x80
+		frame = append(frame, key...)
+		for i, b := range payload {
+			frame = append(frame, b^key[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	_, err := w.Write(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestFrame 读取一个短帧, 去掉掩码并按 rsv1 解压
+func readTestFrame(t *testing.T, r io.Reader) (int, string) {
+	var head [2]byte
+	_, err := io.ReadFull(r, head[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	length := uint64(head[1] & 0x7F)
+	if length == 126 {
+		var b [2]byte
+		io.ReadFull(r, b[:])
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	}
+	var key [4]byte
+	if head[1]&0x80 != 0 {
+		_, err = io.ReadFull(r, key[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range payload {
+		payload[i] ^= key[i%4]
+	}
+	if head[0]&0x40 != 0 {
+		fr := flate.NewReader(io.MultiReader(bytes.NewReader(payload), bytes.NewReader([]byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff})))
+		payload, err = io.ReadAll(fr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return int(head[0] & 0x0F), string(payload)
+}
+
+func testDeflate(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	fw.Write([]byte(s))
+	err := fw.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{0x00, 0x00, 0xff, 0xff})
+}